@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -17,13 +20,17 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
 )
 
 var version string
 
+// log is the logger every repo logger is derived from
+var log = common.Log
+
 // conf holds config and exports for use in other
 // packages
 var conf *config
@@ -33,19 +40,36 @@ var conf *config
 // such as the DynamoDB table name and region
 type config struct {
 	GitHubPAT          string   `yaml:"github_pat"`
+	LogLevel           string   `yaml:"log_level"`
+	LogFormat          string   `yaml:"log_format"`
 	GitHubServer       string   `yaml:"github_server"`
+	Backend            string   `yaml:"backend"`
+	LocalDBPath        string   `yaml:"local_db_path"`
 	DynamoDBRegion     string   `yaml:"dynamodb_region"`
 	DynamoDBTable      string   `yaml:"dynamodb_table"`
 	DynamoDBTriggerKey string   `yaml:"dynamodb_trigger_key"`
 	Interval           int      `yaml:"interval"`
+	FullSyncInterval   int      `yaml:"full_sync_interval"`
+	Concurrency        int      `yaml:"concurrency"`
+	FetchTimeout       int      `yaml:"fetch_timeout"`
+	SyncTimeout        int      `yaml:"sync_timeout"`
+	ListenString       string   `yaml:"listen_string"`
 	GoGetEnvs          []string `yaml:"go_get_envs"`
 	GoBinaryPath       string   `yaml:"go_binary_path"`
+	FetchStrategy      string   `yaml:"fetch_strategy"`
+	UpdateDependencies bool     `yaml:"update_dependencies"`
+	RepoAllow          []string `yaml:"repo_allow"`
+	RepoDeny           []string `yaml:"repo_deny"`
+
+	// repoRules are the compiled repo_allow and
+	// repo_deny patterns
+	repoRules common.RepoRules
 }
 
 // loadConfigSecretsManager takes a secretname and loads it
 // from secrets manager
 func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error {
-	fmt.Println("attempting to load config from secrets manager")
+	log.Infof("attempting to load config from secrets manager")
 	//Create a Secrets Manager client
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		Config: aws.Config{Region: aws.String(secretRegion)},
@@ -61,7 +85,7 @@ func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error
 
 	result, err := svc.GetSecretValue(input)
 	if err != nil {
-		fmt.Printf("Error retrieving secret value. Error: '%s'\n", err.Error())
+		log.Errorf("Error retrieving secret value. Error: '%s'", err.Error())
 		return err
 	}
 
@@ -72,7 +96,7 @@ func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error
 		secretString = *result.SecretString
 		err = yaml.Unmarshal([]byte(secretString), c)
 		if err != nil {
-			fmt.Printf("Error unmarshaling secret text into config object. Error: '%s'\n", err.Error())
+			log.Errorf("Error unmarshaling secret text into config object. Error: '%s'", err.Error())
 			return err
 		}
 	}
@@ -85,41 +109,125 @@ func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error
 // an error if something is wrong with a field.
 func (c *config) setConfigDefaults() (err error) {
 	// set defaults
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = common.LogFormatText
+	}
+	err = common.SetupLogging(c.LogLevel, c.LogFormat)
+	if err != nil {
+		return err
+	}
+	log.Infof("Starting with config '%s = %s'", "LogLevel", c.LogLevel)
+	log.Infof("Starting with config '%s = %s'", "LogFormat", c.LogFormat)
+
 	if c.Interval == 0 {
 		c.Interval = 20
 	}
-	fmt.Printf("Starting with config '%s = %d'\n", "Interval", c.Interval)
+	log.Infof("Starting with config '%s = %d'", "Interval", c.Interval)
+
+	if c.FullSyncInterval == 0 {
+		c.FullSyncInterval = 24 * 60 * 60
+	}
+	log.Infof("Starting with config '%s = %d'", "FullSyncInterval", c.FullSyncInterval)
+
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	log.Infof("Starting with config '%s = %d'", "Concurrency", c.Concurrency)
 
-	if c.DynamoDBRegion == "" {
-		c.DynamoDBRegion = "us-east-1"
+	if c.FetchTimeout == 0 {
+		c.FetchTimeout = 10 * 60
+	}
+	log.Infof("Starting with config '%s = %d'", "FetchTimeout", c.FetchTimeout)
+
+	if c.SyncTimeout == 0 {
+		c.SyncTimeout = 60 * 60
+	}
+	log.Infof("Starting with config '%s = %d'", "SyncTimeout", c.SyncTimeout)
+
+	if c.ListenString != "" {
+		log.Infof("Starting with config '%s = %s'", "ListenString", c.ListenString)
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "DynamoDBRegion", c.DynamoDBRegion)
 
 	if c.GoBinaryPath != "" {
-		fmt.Printf("Starting with config '%s = %s'\n", "GoBinaryPath", c.GoBinaryPath)
+		log.Infof("Starting with config '%s = %s'", "GoBinaryPath", c.GoBinaryPath)
+	}
+
+	if c.FetchStrategy == "" {
+		c.FetchStrategy = fetchGoGet
+	}
+	switch c.FetchStrategy {
+	case fetchGoGet:
+		if c.UpdateDependencies {
+			// go get -u always updates them and can't
+			// update a repo on disk without doing so
+			err = fmt.Errorf("update_dependencies can't be set with fetch_strategy '%s' which always updates dependencies", fetchGoGet)
+			return err
+		}
+	case fetchModule, fetchGit:
+		if _, err = c.gopath(); err != nil {
+			err = fmt.Errorf("fetch_strategy '%s' needs GOPATH set in go_get_envs", c.FetchStrategy)
+			return err
+		}
+	default:
+		err = fmt.Errorf("unknown fetch_strategy '%s', must be '%s', '%s' or '%s'", c.FetchStrategy, fetchGoGet, fetchModule, fetchGit)
+		return err
 	}
+	log.Infof("Starting with config '%s = %s'", "FetchStrategy", c.FetchStrategy)
+	log.Infof("Starting with config '%s = %t'", "UpdateDependencies", c.UpdateDependencies)
 
 	if c.GitHubPAT == "" {
 		c.GitHubPAT = ""
 	}
-	fmt.Printf("Starting with config '%s = [redacted] (but has length %d)'\n", "GitHubPAT", len(c.GitHubPAT))
+	common.RedactSecret(c.GitHubPAT)
+	log.Infof("Starting with config '%s = [redacted] (but has length %d)'", "GitHubPAT", len(c.GitHubPAT))
 
 	if c.GitHubServer == "" {
 		err = errors.New("missing configuration directive github_server")
 		return err
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "GitHubServer", c.GitHubServer)
+	log.Infof("Starting with config '%s = %s'", "GitHubServer", c.GitHubServer)
+
+	if c.Backend == "" {
+		c.Backend = registry.BackendDynamoDB
+	}
+	log.Infof("Starting with config '%s = %s'", "Backend", c.Backend)
 
-	if c.DynamoDBTable == "" {
-		err = errors.New("missing configuration directive dynamodb_table")
+	switch c.Backend {
+	case registry.BackendDynamoDB:
+		if c.DynamoDBRegion == "" {
+			c.DynamoDBRegion = "us-east-1"
+		}
+		log.Infof("Starting with config '%s = %s'", "DynamoDBRegion", c.DynamoDBRegion)
+
+		if c.DynamoDBTable == "" {
+			err = errors.New("missing configuration directive dynamodb_table")
+			return err
+		}
+		log.Infof("Starting with config '%s = %s'", "DynamoDBTable", c.DynamoDBTable)
+	case registry.BackendLocal:
+		if c.LocalDBPath == "" {
+			c.LocalDBPath = "/var/lib/goarder/registry.db"
+		}
+		log.Infof("Starting with config '%s = %s'", "LocalDBPath", c.LocalDBPath)
+	default:
+		err = fmt.Errorf("unknown backend '%s', must be '%s' or '%s'", c.Backend, registry.BackendDynamoDB, registry.BackendLocal)
 		return err
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "DynamoDBTable", c.DynamoDBTable)
 
 	if c.DynamoDBTriggerKey == "" {
 		c.DynamoDBTriggerKey = "00000trigger"
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "DynamoDBTriggerKey", c.DynamoDBTriggerKey)
+	log.Infof("Starting with config '%s = %s'", "DynamoDBTriggerKey", c.DynamoDBTriggerKey)
+
+	c.repoRules, err = common.NewRepoRules(c.RepoAllow, c.RepoDeny)
+	if err != nil {
+		return err
+	}
+	log.Infof("Starting with config '%s = %s'", "RepoAllow", strings.Join(c.RepoAllow, ","))
+	log.Infof("Starting with config '%s = %s'", "RepoDeny", strings.Join(c.RepoDeny, ","))
 	return err
 }
 
@@ -145,80 +253,95 @@ var counter *int
 // events happen we know which repos to delete
 var localRepos []string
 
+// syncedCommits maps the import path of each repo on disk
+// to the commit it was last fetched at so that a sync only
+// fetches the repos that changed
+var syncedCommits = make(map[string]string)
+
+// lastFullSync is when every repo was last fetched
+// regardless of whether its commit changed
+var lastFullSync time.Time
+
+// fullSyncDue reports whether every repo should be fetched
+// again, e.g., to pick up changes to their dependencies. A
+// negative full_sync_interval only does so on startup.
+func fullSyncDue(now time.Time) bool {
+	if lastFullSync.IsZero() {
+		return true
+	}
+	if conf.FullSyncInterval < 0 {
+		return false
+	}
+	return now.Sub(lastFullSync) >= time.Duration(conf.FullSyncInterval)*time.Second
+}
+
 type Trigger struct {
 	Repo  string `json:"repo"`
 	Count *int   `json:"count"`
 }
 
 func (t *Trigger) GetCounter() (err error) {
-	sess, err := session.NewSession(
-		&aws.Config{Region: aws.String(conf.DynamoDBRegion)},
-	)
+	cnt, err := reg.GetTrigger()
 	if err != nil {
+		log.Errorf("Error retrieving trigger value: %s", err.Error())
 		return err
 	}
-	dsvc := dynamodb.New(sess)
-	kvalue := make(map[string]*dynamodb.AttributeValue)
-	kvalue["repo"] = &dynamodb.AttributeValue{
-		S: aws.String(conf.DynamoDBTriggerKey)}
-	getItemInput := dynamodb.GetItemInput{
-		Key:       kvalue,
-		TableName: &conf.DynamoDBTable,
-	}
-	rvalue, err := dsvc.GetItem(&getItemInput)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	if val, ok := rvalue.Item["count"]; ok {
-		cnt := 0
-		err = dynamodbattribute.Unmarshal(val, &cnt)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Detected count as %d\n", cnt)
-		t.Count = &cnt
-	}
+	log.Debugf("Detected count as %d", cnt)
+	state.setTrigger(cnt)
+	t.Count = &cnt
 	return err
 }
 
 func AppCleanup() {
-	fmt.Println("CLEANUP APP BEFORE EXIT!!!")
+	log.Infof("CLEANUP APP BEFORE EXIT!!!")
 }
 
-func getRepos() (repos []string, err error) {
-	sess, err := session.NewSession(
-		&aws.Config{Region: aws.String(conf.DynamoDBRegion)},
-	)
+// getRepos returns a job for each registered repo that passes
+// the repo rules with the modules registered as its children
+func getRepos(lg *common.Logger) (jobs []*repoJob, err error) {
+	recs, err := reg.ListRepos()
 	if err != nil {
-		return repos, err
-	}
-	dsvc := dynamodb.New(sess)
-	params := dynamodb.ScanInput{
-		TableName: &conf.DynamoDBTable,
-	}
-	maxpages := 50
-	// Example iterating over at most 3 pages of a Scan operation.
-	pageNum := 0
-	err = dsvc.ScanPages(&params,
-		func(page *dynamodb.ScanOutput, lastPage bool) bool {
-			pageNum++
-			for _, item := range page.Items {
-				if _, ok := item["repo"]; ok {
-					repoName := *item["repo"].S
-					if repoName != conf.DynamoDBTriggerKey {
-						repos = append(repos, repoName)
-					}
-				}
-			}
-			return pageNum <= maxpages
-		})
-	return repos, err
+		return jobs, err
+	}
+	// modules nested in a repo are registered
+	// by us as children of the repo
+	children := make(map[string][]registry.Record)
+	for _, rec := range recs {
+		if rec.Parent != "" {
+			children[rec.Parent] = append(children[rec.Parent], rec)
+		}
+	}
+	for _, rec := range recs {
+		if rec.Parent != "" {
+			continue
+		}
+		if rerr := conf.repoRules.Check(rec.Repo); rerr != nil {
+			lg.Warnf("skipping %s", rerr.Error())
+			continue
+		}
+		jobs = append(jobs, &repoJob{root: rec, modules: children[rec.Repo]})
+	}
+	return jobs, err
+}
+
+// usableRepo checks the import path of rec and the repo rules
+// again now that its module path is known and logs why rec is
+// skipped if it can't be fetched
+func usableRepo(lg *common.Logger, rec registry.Record) bool {
+	if err := checkImportPath(rec.ImportPath()); err != nil {
+		lg.Warnf("skipping repo '%s': %s", rec.Repo, err.Error())
+		return false
+	}
+	if err := checkRepoRules(rec); err != nil {
+		lg.Warnf("skipping %s", err.Error())
+		return false
+	}
+	return true
 }
 
 func handle(err error) {
 	if err != nil {
-		fmt.Println(err)
+		log.Errorf("%s", err.Error())
 		os.Exit(1)
 	}
 }
@@ -232,7 +355,7 @@ func manageGitconfig() {
 	if len(conf.GitHubPAT) < 1 {
 		return
 	}
-	fmt.Println("setting up PAT for GitHub server")
+	log.Infof("setting up PAT for GitHub server")
 	ghServerStringHttps1 := fmt.Sprintf(
 		`[url "https://%s@%s"]`,
 		conf.GitHubPAT, conf.GitHubServer,
@@ -267,97 +390,131 @@ func manageGitconfig() {
 			handle(err)
 		}
 	}
-	fmt.Printf("wrote %d lines to %s\n", len(linesToWrite), filename)
+	log.Infof("wrote %d lines to %s", len(linesToWrite), filename)
 	writer.Flush()
 }
 
-func update() (err error) {
-	repos, err := getRepos()
+// newSyncID returns a random ID for a sync cycle
+func newSyncID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// update fetches the registered repos whose commit changed
+// since they were last fetched, or every repo if full is
+// set, and removes those that are no longer registered. lg
+// carries the ID of the sync cycle. If ctx is done before
+// every repo is fetched its error is returned and nothing
+// is removed.
+func update(ctx context.Context, lg *common.Logger, full bool) (err error) {
+	all, err := getRepos(lg)
 	if err != nil {
 		return err
 	}
-	fmt.Print("done getting repos, 'go get'ting them and ignoring errors\n")
-	for _, repo := range repos {
-		fmt.Printf("performing 'go get -u -d' for repo '%s'\n", repo)
-		var cmd *exec.Cmd
-		if conf.GoBinaryPath == "" {
-			cmd = exec.Command("go", "get", "-u", "-d", repo)
-		} else {
-			cmd = exec.Command(
-				conf.GoBinaryPath, "get", "-u", "-d", repo,
-			)
+	var jobs []*repoJob
+	registeredPaths = map[string]bool{}
+	claims := newPathClaims(all)
+	for _, j := range all {
+		j.claims = claims
+		commit, resolved := resolvedCommits[j.root.Repo]
+		j.resolve = !resolved || commit != j.root.LastCommitId
+		synced := true
+		for _, rec := range append([]registry.Record{j.root}, j.modules...) {
+			registeredPaths[rec.ImportPath()] = true
+			if syncedCommits[rec.ImportPath()] != j.root.LastCommitId {
+				synced = false
+			}
 		}
-
-		cmd.Env = os.Environ()
-		for _, env := range conf.GoGetEnvs {
-			cmd.Env = append(cmd.Env, env)
+		if !full && synced {
+			lg.Debugf("repo '%s' is still at commit '%s', skipping", j.root.Repo, j.root.LastCommitId)
+			// whatever is on disk stays
+			j.setRepos(lg)
+			continue
 		}
-		cmd.Stderr = os.Stdout
-		out, err := cmd.Output()
-		if err != nil {
-			fmt.Printf("len(out) = %d, got error: '%s'\n", len(out), err.Error())
-			if out != nil {
-				fmt.Println(string(out))
-			}
+		jobs = append(jobs, j)
+	}
+	lg.Infof("done getting repos, syncing %d of %d and ignoring errors", len(jobs), len(all))
+	runJobs(ctx, lg, jobs)
+	var repos []string
+	var fetched, failed []fetchResult
+	for _, j := range all {
+		if j.resolved {
+			resolvedCommits[j.root.Repo] = j.root.LastCommitId
 		}
-		// add to a local copy so we can compare later for deletion
-		localRepos = append(localRepos, repo)
-
+		for _, rec := range j.repos {
+			repos = append(repos, rec.ImportPath())
+		}
+		fetched = append(fetched, j.results...)
+		fetched = append(fetched, j.conflicts...)
+	}
+	for _, res := range fetched {
+		repo := res.rec.ImportPath()
+		rlg := lg.With("repo", repo).With("output", string(res.output))
+		state.recordFetch(repo, res.rec.LastCommitId, res.duration, res.exitStatus, res.err)
+		if res.err != nil {
+			rlg.Errorf("len(out) = %d, got error: '%s'", len(res.output), res.err.Error())
+			failed = append(failed, res)
+			continue
+		}
+		rlg.Debugf("fetched repo '%s' in %s", repo, res.duration)
+		// failed repos are left out so they
+		// are tried again on the next sync
+		syncedCommits[repo] = res.rec.LastCommitId
+	}
+	if len(failed) > 0 {
+		lg.Warnf("%d of %d repos failed to fetch", len(failed), len(fetched))
+		for _, res := range failed {
+			lg.With("repo", res.rec.ImportPath()).Warnf("failed to fetch repo '%s': %s", res.rec.ImportPath(), res.err.Error())
+		}
+	}
+	if ctx.Err() != nil {
+		// repos that weren't fetched are still missing
+		// so don't count this as a finished sync
+		return ctx.Err()
 	}
 	// now check to see if any previous repos are now missing from list
 	var reposToDelete []string
 	for _, lrepo := range localRepos {
 		missing := true
 		for _, r := range repos {
-			if r == lrepo {
+			// a repo still on disk below lrepo, e.g., after
+			// its module path gained a /v2, keeps it around
+			if r == lrepo || strings.HasPrefix(r, lrepo+"/") {
 				missing = false
 			}
 		}
 		if missing {
-			fmt.Printf("Adding repo to delete '%s'\n", lrepo)
+			lg.Infof("Adding repo to delete '%s'", lrepo)
 			reposToDelete = append(reposToDelete, lrepo)
+			delete(syncedCommits, lrepo)
 		}
 	}
 	// now delete them
 	for _, repo := range reposToDelete {
-		fullPathToDelete := fmt.Sprintf("src/%s", repo)
-		fmt.Printf("attempting to perform  'rm -rf' for local source of '%s/%s'\n", "$GOPATH", fullPathToDelete)
-		var cmd *exec.Cmd
-		cmd = exec.Command("rm", "-rf", "-d", fullPathToDelete)
-
-		cmd.Env = os.Environ()
-		fmt.Println("attempting to perform GOPATH expansion and cmd injection")
-		var gopath string
-		for _, env := range conf.GoGetEnvs {
-			fmt.Printf("Have env of '%s'\n", env)
-			chunked := strings.Split(env, "=")
-			if len(chunked) > 1 {
-				if chunked[0] == "GOPATH" {
-					fmt.Println("found GOPATH env var")
-					gopath = chunked[1]
-				}
-			}
-			cmd.Env = append(cmd.Env, env)
+		if _, err = conf.gopath(); err != nil {
+			return errors.New("GOPATH env var empty unable to determine full delete path")
 		}
-		if len(gopath) > 0 {
-			finalPath := fmt.Sprintf("%s/%s", gopath, fullPathToDelete)
-			cmd.Args[3] = finalPath
-			fmt.Printf("Got full path embedded in cmd of '%s'\n", finalPath)
-		} else {
-			err = errors.New("GOPATH env var empty unable to determine full delete path")
+		finalPath, perr := srcDir(repo)
+		if perr != nil {
+			lg.Errorf("not deleting local source of '%s': %s", repo, perr.Error())
+			continue
 		}
+		lg.Infof("attempting to perform 'rm -rf' for local source of '%s'", finalPath)
+		cmd := exec.Command("rm", "-rf", "-d", finalPath)
+		cmd.Env = append(os.Environ(), conf.GoGetEnvs...)
+		out, err := cmd.CombinedOutput()
 		if err != nil {
-			return err
-		}
-		cmd.Stderr = os.Stdout
-		out, err := cmd.Output()
-		if err != nil {
-			fmt.Printf("len(out) = %d, got error: '%s'\n", len(out), err.Error())
-			if out != nil {
-				fmt.Println(string(out))
-			}
+			lg.With("output", string(out)).Errorf("len(out) = %d, got error: '%s'", len(out), err.Error())
 		}
 	}
+	// keep a local copy so we can compare next time for
+	// deletion, the deleted repos are gone from disk now
+	localRepos = repos
+	state.setLocalRepos(localRepos)
 	// requires user running 'ahoy' can control this service
 	// example in sudoers file:
 	//  Cmnd_Alias GOARDER_CMNDS = /bin/systemctl start godocs, /bin/systemctl stop godocs, /bin/systemctl restart godocs.service
@@ -382,57 +539,98 @@ func main() {
 		fmt.Printf("ahoy %s\n", version)
 		os.Exit(0)
 	}
-	fmt.Printf("ahoy %s\n", version)
+	log.Infof("ahoy %s", version)
 	// process config. First try to load from config file
 	// if that fails load from secrets manager
 	err := c.loadConfigFile(configFile)
 	if err != nil {
-		fmt.Printf("Unable to load config from file. Error: '%s'\n", err.Error())
+		log.Errorf("Unable to load config from file. Error: '%s'", err.Error())
 		err := c.loadConfigSecretsManager(secretName, secretRegion)
 		if err != nil {
-			fmt.Printf("Unable to load config from secrets manager. Error: '%s'\n", err.Error())
+			log.Errorf("Unable to load config from secrets manager. Error: '%s'", err.Error())
 			os.Exit(1)
 		}
 	}
+	reg, err = newRegistry(conf)
+	if err != nil {
+		log.Errorf("Unable to set up %s registry. Error: '%s'", conf.Backend, err.Error())
+		os.Exit(1)
+	}
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	starter := 0
 	counter = &starter
-	go sigCatcher(sigs)
+	ctx, cancel := context.WithCancel(context.Background())
+	go sigCatcher(sigs, cancel)
+	if conf.ListenString != "" {
+		go serveStatus(conf.ListenString)
+	}
 	manageGitconfig()
-	for {
+	for ctx.Err() == nil {
 		var t Trigger
 		// wake up, check trigger
 		t.Count = &[]int{0}[0]
 		err := t.GetCounter()
 		if err != nil {
-			fmt.Printf("Fatal error, exiting: %s\n", err.Error())
+			log.Errorf("Fatal error, exiting: %s", err.Error())
 			os.Exit(1)
 		}
-		if *counter != *t.Count {
+		full := fullSyncDue(time.Now())
+		if *counter != *t.Count || full {
 			// if counter is diff then we update
-			err = update()
-			if err != nil {
-				fmt.Printf("Fatal error, exiting: %s\n", err.Error())
+			lg := log.With("sync_id", newSyncID())
+			if full {
+				lg.Infof("full sync due, fetching every repo")
+			} else {
+				lg.Infof("trigger changed from %d to %d, syncing", *counter, *t.Count)
+			}
+			start := time.Now()
+			syncCtx, cancelSync := context.WithTimeout(ctx, time.Duration(conf.SyncTimeout)*time.Second)
+			err = update(syncCtx, lg, full)
+			cancelSync()
+			state.recordSync(err)
+			if full && (err == nil || err == context.DeadlineExceeded) {
+				// a full sync that ran out of time isn't
+				// repeated right away, the repos it missed
+				// are fetched by the next sync
+				lastFullSync = start
+			}
+			switch {
+			case ctx.Err() != nil:
+				lg.Infof("sync stopped before it finished")
+			case err == context.DeadlineExceeded:
+				lg.Errorf("sync did not finish within %ds, trying again in %ds", conf.SyncTimeout, conf.Interval)
+			case err != nil:
+				lg.Errorf("Fatal error, exiting: %s", err.Error())
 				os.Exit(1)
+			default:
+				counter = t.Count
+				state.setCounter(*counter)
+				lg.Infof("set new local counter to %d", *counter)
 			}
-			counter = t.Count
-			fmt.Printf("set new local counter to %d\n", *counter)
 		} else {
 			// otherwise go back to sleep
-			fmt.Println("nothing to do, sleeping")
+			log.Debugf("nothing to do, sleeping")
+		}
+		log.Debugf("sleeping %ds before checking for updates", conf.Interval)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(conf.Interval) * time.Second):
 		}
-		fmt.Printf("sleeping %ds before checking for updates\n", conf.Interval)
-		time.Sleep(time.Millisecond * time.Duration(conf.Interval*1000))
 	}
+	AppCleanup()
+	log.Infof("exiting")
 }
 
 // sigCatcher waits for os signals to terminate gracefully
-// after it receives a signal on the sigs channel.
-// main() waits for a bool on the done channel.
-func sigCatcher(sigs chan os.Signal) {
+// after it receives a signal on the sigs channel. cancel
+// stops the sync in progress, killing any fetches, and
+// main() exits once it has. A second signal exits at once.
+func sigCatcher(sigs chan os.Signal, cancel context.CancelFunc) {
 	sig := <-sigs
-	fmt.Printf("received signal '%s'\n", sig)
-	AppCleanup()
+	log.Infof("received signal '%s', stopping", sig)
+	cancel()
+	sig = <-sigs
+	log.Warnf("received signal '%s' again, exiting now", sig)
 	os.Exit(1)
 }
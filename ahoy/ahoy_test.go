@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// fakeGo writes a go command that appends the repo it is
+// asked to get to the returned log and then runs script
+func fakeGo(t *testing.T, script string) (bin, logFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	bin = filepath.Join(dir, "go")
+	logFile = filepath.Join(dir, "go.log")
+	data := "#!/bin/sh\necho \"$4\" >> " + logFile + "\n" + script + "\n"
+	if err := ioutil.WriteFile(bin, []byte(data), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return bin, logFile
+}
+
+// fakeGoCalls returns the repos logged by fakeGo
+// since it was last called and clears the log
+func fakeGoCalls(t *testing.T, logFile string) (repos []string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(logFile)
+	if os.IsNotExist(err) {
+		return repos
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(logFile)
+	repos = strings.Fields(string(data))
+	sort.Strings(repos)
+	return repos
+}
+
+func TestUpdateIncremental(t *testing.T) {
+	const (
+		sha1 = "0123456789abcdef0123456789abcdef01234567"
+		sha2 = "89abcdef0123456789abcdef0123456789abcdef"
+		a    = "github.company.com/Org/a"
+		b    = "github.company.com/Org/b"
+		// c fails to fetch so it is tried again every sync
+		c = "github.company.com/Org/c"
+	)
+	// the clones that read go.mod fail at once
+	t.Setenv("GIT_ALLOW_PROTOCOL", "file")
+	bin, logFile := fakeGo(t, `case "$4" in */c) exit 1;; esac`)
+	dir := t.TempDir()
+	conf = &config{GitHubServer: "x", Backend: registry.BackendLocal, LocalDBPath: filepath.Join(dir, "registry.db"), GoBinaryPath: bin, Concurrency: 2, GoGetEnvs: []string{"GOPATH=" + filepath.Join(dir, "gopath")}}
+	if err := conf.setConfigDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	reg = registry.NewBolt(conf.LocalDBPath)
+	resolvedCommits = make(map[string]string)
+	syncedCommits = make(map[string]string)
+	localRepos = nil
+	cases := []struct {
+		name   string
+		commit map[string]string
+		full   bool
+		want   []string
+	}{
+		{"first sync", map[string]string{a: sha1, b: sha1, c: sha1}, false, []string{a, b, c}},
+		{"nothing changed", nil, false, []string{c}},
+		{"one repo changed", map[string]string{b: sha2}, false, []string{b, c}},
+		{"full sync", nil, true, []string{a, b, c}},
+	}
+	for _, tc := range cases {
+		for repo, commit := range tc.commit {
+			if err := reg.PutRepo(registry.Record{Repo: repo, LastCommitId: commit}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := update(context.Background(), log, tc.full); err != nil {
+			t.Fatalf("%s: update = %v", tc.name, err)
+		}
+		got := fakeGoCalls(t, logFile)
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s: fetched %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if syncedCommits[b] != sha2 || syncedCommits[c] != "" {
+		t.Errorf("synced commits = %v, want b at %q and no c", syncedCommits, sha2)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// killGracePeriod is how long a command has to exit after
+// it is sent a SIGTERM before it is killed
+const killGracePeriod = 10 * time.Second
+
+// newCommand returns a command that is stopped when ctx is
+// done. It runs in its own process group so that everything
+// it starts, e.g., the git processes of go get, is sent the
+// SIGTERM too rather than being left behind.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = killGracePeriod
+	return cmd
+}
+
+// fetchTimeout returns the most time a single repo
+// is given to be fetched
+func fetchTimeout() time.Duration {
+	return time.Duration(conf.FetchTimeout) * time.Second
+}
+
+// fetchResult is the outcome of fetching a single repo
+type fetchResult struct {
+	rec registry.Record
+	// output is everything the fetch wrote to stdout and
+	// stderr so it can be logged in one piece
+	output     []byte
+	err        error
+	exitStatus int
+	duration   time.Duration
+}
+
+// fetchRepo fetches rec with the configured fetch_strategy. It is stopped if it takes
+// longer than fetch_timeout or ctx is done.
+func fetchRepo(ctx context.Context, lg *common.Logger, rec registry.Record) (res fetchResult) {
+	res.rec = rec
+	if ctx.Err() != nil {
+		// the sync was stopped before this repo's turn
+		res.err = ctx.Err()
+		res.exitStatus = -1
+		return res
+	}
+	fctx, cancel := context.WithTimeout(ctx, fetchTimeout())
+	defer cancel()
+	start := time.Now()
+	switch conf.FetchStrategy {
+	case fetchModule:
+		res.output, res.err = downloadModule(fctx, lg, rec)
+	case fetchGit:
+		res.output, res.err = gitCheckout(fctx, lg, rec)
+	default:
+		res.output, res.err = goGet(fctx, lg, rec)
+	}
+	res.duration = time.Since(start)
+	if res.err != nil && ctx.Err() != nil {
+		res.err = fmt.Errorf("stopped with the sync (%s): %w", ctx.Err().Error(), res.err)
+	} else if res.err != nil && fctx.Err() == context.DeadlineExceeded {
+		res.err = fmt.Errorf("timed out after %s: %w", fetchTimeout(), res.err)
+	}
+	if res.err != nil {
+		res.exitStatus = -1
+		var exitErr *exec.ExitError
+		if errors.As(res.err, &exitErr) {
+			res.exitStatus = exitErr.ExitCode()
+		}
+	}
+	return res
+}
+
+// goBinary returns the go command to run
+func goBinary() string {
+	if conf.GoBinaryPath == "" {
+		return "go"
+	}
+	return conf.GoBinaryPath
+}
+
+// goEnv returns the environment to run the go command
+// in with go_get_envs added
+func goEnv() (env []string) {
+	env = os.Environ()
+	for _, e := range conf.GoGetEnvs {
+		env = append(env, e)
+	}
+	return env
+}
+
+// goGet runs 'go get -u -d' for rec which needs a Go release
+// that still supports GOPATH mode. It always updates the
+// dependencies since without -u go get leaves a repo that
+// is already on disk alone.
+func goGet(ctx context.Context, lg *common.Logger, rec registry.Record) (out []byte, err error) {
+	repo := rec.ImportPath()
+	lg.Infof("performing 'go get -u -d' for repo '%s'", repo)
+	cmd := newCommand(ctx, goBinary(), "get", "-u", "-d", repo)
+	cmd.Env = goEnv()
+	return cmd.CombinedOutput()
+}
+
+// repoJob is a registered repo and the modules nested in it.
+// A single worker handles the whole job so the modules are
+// found at the same commit the repo is fetched at.
+type repoJob struct {
+	root registry.Record
+	// modules are the modules registered as children of root
+	// and are replaced if resolve is set
+	modules []registry.Record
+	// resolve is set if the modules have to be looked for
+	// again since root changed since they were last found
+	resolve bool
+	// resolved is set once the modules were found at the
+	// commit of root
+	resolved bool
+	// repos are root and the modules that may be fetched,
+	// i.e., the ones that should be on disk after the job
+	repos []registry.Record
+	// results holds the outcome of each fetch
+	results []fetchResult
+	// conflicts holds a failed result for each record that
+	// wasn't fetched since another repo claimed its path
+	conflicts []fetchResult
+	// claims is shared by the jobs of a sync
+	claims *pathClaims
+}
+
+// pathClaims records which repo each import path belongs to
+// during a sync. Module paths come from go.mod which anyone
+// who can push to a repo controls, so a path claimed by one
+// repo is never fetched for another.
+type pathClaims struct {
+	mu    sync.Mutex
+	repos map[string]string
+}
+
+// newPathClaims returns the claims of the import paths the
+// records of jobs are registered under. Records whose import
+// path is their repo name claim it first so that a go.mod
+// can't take the path of another repo away from it.
+func newPathClaims(jobs []*repoJob) *pathClaims {
+	c := &pathClaims{repos: make(map[string]string)}
+	for _, named := range []bool{true, false} {
+		for _, j := range jobs {
+			for _, rec := range append([]registry.Record{j.root}, j.modules...) {
+				if (rec.ImportPath() == rec.Repo) == named {
+					c.claim(rec.ImportPath(), rec.Repo)
+				}
+			}
+		}
+	}
+	return c
+}
+
+// claim records path as belonging to repo unless
+// another repo claimed it first
+func (c *pathClaims) claim(path, repo string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if owner, ok := c.repos[path]; ok && owner != repo {
+		return fmt.Errorf("import path '%s' of repo '%s' is already claimed by repo '%s'", path, repo, owner)
+	}
+	c.repos[path] = repo
+	return nil
+}
+
+// run resolves the modules of the job's repo if needed and
+// fetches the repo and its modules
+func (j *repoJob) run(ctx context.Context, lg *common.Logger) {
+	if ctx.Err() != nil {
+		// the sync was stopped before this job's turn
+		j.resolve = false
+	}
+	if conf.FetchStrategy == fetchGit {
+		j.runGit(ctx, lg)
+		return
+	}
+	if j.resolve {
+		dir, err := cloneAt(ctx, j.root)
+		if err != nil {
+			lg.Errorf("unable to resolve modules for repo '%s': %s", j.root.Repo, err.Error())
+		} else {
+			j.modules, j.resolved = syncModules(lg, &j.root, j.modules, dir)
+		}
+		os.RemoveAll(dir)
+	}
+	j.setRepos(lg)
+	for _, rec := range j.repos {
+		j.results = append(j.results, fetchRepo(ctx, lg, rec))
+	}
+}
+
+// setRepos sets j.repos to the records of the job that are
+// allowed to be fetched now that their module paths are known
+func (j *repoJob) setRepos(lg *common.Logger) {
+	j.repos = nil
+	j.conflicts = nil
+	if !j.usable(lg, j.root) {
+		return
+	}
+	j.repos = append(j.repos, j.root)
+	for _, mod := range j.modules {
+		mod.LastCommitId = j.root.LastCommitId
+		if j.usable(lg, mod) {
+			j.repos = append(j.repos, mod)
+		}
+	}
+}
+
+// usable reports whether rec may be fetched by the job. If
+// another repo claimed its import path a failed result is
+// added to the job's conflicts.
+func (j *repoJob) usable(lg *common.Logger, rec registry.Record) bool {
+	if !usableRepo(lg, rec) {
+		return false
+	}
+	if j.claims == nil {
+		return true
+	}
+	err := j.claims.claim(rec.ImportPath(), rec.Repo)
+	if err != nil {
+		lg.Errorf("skipping %s", err.Error())
+		// report it under the repo's own name since
+		// the status of the path is the other repo's
+		failed := rec
+		failed.ModulePath = ""
+		j.conflicts = append(j.conflicts, fetchResult{rec: failed, err: err, exitStatus: -1})
+		return false
+	}
+	return true
+}
+
+// runJobs runs jobs with up to conf.Concurrency of them
+// running at once. Jobs that didn't start before ctx was
+// done have its error as the result of their fetches.
+func runJobs(ctx context.Context, lg *common.Logger, jobs []*repoJob) {
+	work := make(chan *repoJob)
+	var wg sync.WaitGroup
+	for w := 0; w < conf.Concurrency && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				j.run(ctx, lg)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+func TestPathClaims(t *testing.T) {
+	conf = &config{}
+	// the evil repo's go.mod claims the path of lib and is
+	// listed first but lib is registered under the path
+	evil := &repoJob{root: registry.Record{Repo: "github.company.com/Org/evil", ModulePath: "github.company.com/Org/lib"}}
+	lib := &repoJob{root: registry.Record{Repo: "github.company.com/Org/lib"}}
+	other := &repoJob{root: registry.Record{Repo: "github.company.com/Org/other", ModulePath: "vanity.company.com/other"}}
+	copycat := &repoJob{root: registry.Record{Repo: "github.company.com/Org/copycat", ModulePath: "vanity.company.com/other"}}
+	jobs := []*repoJob{evil, lib, other, copycat}
+	claims := newPathClaims(jobs)
+	cases := []struct {
+		job  *repoJob
+		want bool
+	}{
+		{evil, false},
+		{lib, true},
+		{other, true},
+		{copycat, false},
+	}
+	for _, tc := range cases {
+		tc.job.claims = claims
+		tc.job.setRepos(log)
+		if got := len(tc.job.repos) == 1; got != tc.want {
+			t.Errorf("repo '%s' fetched = %t, want %t", tc.job.root.Repo, got, tc.want)
+		}
+		if got := len(tc.job.conflicts) == 1; got == tc.want {
+			t.Errorf("repo '%s' has conflicts %v", tc.job.root.Repo, tc.job.conflicts)
+		}
+	}
+	// a path first found while the jobs run goes to the
+	// first repo to claim it
+	if err := claims.claim("vanity.company.com/new", "github.company.com/Org/lib"); err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.claim("vanity.company.com/new", "github.company.com/Org/other"); err == nil {
+		t.Error("a second repo claimed the same new path")
+	}
+	if got := copycat.conflicts[0].rec.ImportPath(); got != copycat.root.Repo {
+		t.Errorf("conflict reported under '%s', want the repo name", got)
+	}
+}
+
+func TestRunJobs(t *testing.T) {
+	// each fetch logs when it starts and ends next to the
+	// fake go command and fails for repos ending in /bad
+	bin, _ := fakeGo(t, `echo + >> "$0.events"; sleep 0.2; echo - >> "$0.events"; case "$4" in */bad) exit 1;; esac`)
+	cases := []struct {
+		concurrency int
+		jobs        int
+	}{
+		{1, 3},
+		{2, 6},
+		{4, 3},
+	}
+	for _, tc := range cases {
+		conf = &config{GoBinaryPath: bin, FetchTimeout: 60, Concurrency: tc.concurrency}
+		var jobs []*repoJob
+		for i := 0; i < tc.jobs; i++ {
+			repo := fmt.Sprintf("github.company.com/Org/repo%d", i)
+			if i == 0 {
+				repo = "github.company.com/Org/bad"
+			}
+			jobs = append(jobs, &repoJob{root: registry.Record{Repo: repo}})
+		}
+		runJobs(context.Background(), log, jobs)
+		for i, j := range jobs {
+			if len(j.results) != 1 {
+				t.Errorf("concurrency %d: job %d has %d results, want 1", tc.concurrency, i, len(j.results))
+				continue
+			}
+			if failed := j.results[0].err != nil; failed != (i == 0) {
+				t.Errorf("concurrency %d: job %d failed = %t: %v", tc.concurrency, i, failed, j.results[0].err)
+			}
+		}
+		events, err := ioutil.ReadFile(bin + ".events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		running, most := 0, 0
+		for _, e := range strings.Fields(string(events)) {
+			if e == "+" {
+				running++
+			} else {
+				running--
+			}
+			if running > most {
+				most = running
+			}
+		}
+		want := tc.concurrency
+		if tc.jobs < want {
+			want = tc.jobs
+		}
+		if most != want {
+			t.Errorf("concurrency %d: %d fetches ran at once, want %d", tc.concurrency, most, want)
+		}
+		os.Remove(bin + ".events")
+	}
+}
+
+// processRunning reports whether the process with pid is
+// still running rather than gone or waiting to be reaped
+func processRunning(pid string) bool {
+	stat, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestFetchTimeouts(t *testing.T) {
+	// the slow fetch starts a child like go get starts git
+	slow, _ := fakeGo(t, `sleep 30 & echo $! > "$0.pid"; wait`)
+	fast, fastLog := fakeGo(t, "exit 0")
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name    string
+		bin     string
+		timeout int
+		sync    time.Duration
+		ctx     context.Context
+		wantErr string
+	}{
+		{"fast fetch", fast, 60, time.Minute, nil, ""},
+		{"fetch_timeout", slow, 1, time.Minute, nil, "timed out after 1s"},
+		{"sync stopped", slow, 60, 500 * time.Millisecond, nil, "stopped with the sync"},
+		{"sync already stopped", fast, 60, time.Minute, done, context.Canceled.Error()},
+	}
+	for _, tc := range cases {
+		conf = &config{GoBinaryPath: tc.bin, FetchTimeout: tc.timeout}
+		ctx := tc.ctx
+		if ctx == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.Background(), tc.sync)
+			defer cancel()
+		}
+		os.Remove(fastLog)
+		start := time.Now()
+		res := fetchRepo(ctx, log, registry.Record{Repo: "github.company.com/Org/repo"})
+		if took := time.Since(start); took > 10*time.Second {
+			t.Errorf("%s: fetch took %s", tc.name, took)
+		}
+		if tc.wantErr == "" {
+			if res.err != nil {
+				t.Errorf("%s: err = %v, want nil", tc.name, res.err)
+			}
+			continue
+		}
+		if res.err == nil || !strings.Contains(res.err.Error(), tc.wantErr) || res.exitStatus != -1 {
+			t.Errorf("%s: err = %v exit status = %d, want %q and -1", tc.name, res.err, res.exitStatus, tc.wantErr)
+		}
+		if tc.bin == fast {
+			if _, err := os.Stat(fastLog); err == nil {
+				t.Errorf("%s: go was run after the sync was stopped", tc.name)
+			}
+			continue
+		}
+		pid, err := ioutil.ReadFile(slow + ".pid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the child is sent the signal with the fetch but
+		// may take a moment to exit
+		for i := 0; i < 20 && processRunning(strings.TrimSpace(string(pid))); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if processRunning(strings.TrimSpace(string(pid))) {
+			t.Errorf("%s: the child of the fetch is still running", tc.name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// runGit runs git with args in dir and appends what
+// it writes to out
+func runGit(ctx context.Context, dir string, out *[]byte, args ...string) (err error) {
+	cmd := newCommand(ctx, "git", args...)
+	cmd.Dir = dir
+	// fail instead of waiting for credentials on stdin
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	o, err := cmd.CombinedOutput()
+	*out = append(*out, o...)
+	if err != nil {
+		err = fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return err
+}
+
+// gitCheckout checks rec out at its last commit in
+// $GOPATH/src/<import path> with git. The repo is shallow
+// cloned the first time and after that the commit is fetched
+// and reset to in place. An existing directory is only reused
+// if it is a checkout of the repo, e.g., one made by go get.
+func gitCheckout(ctx context.Context, lg *common.Logger, rec registry.Record) (out []byte, err error) {
+	path := rec.ImportPath()
+	dst, err := srcDir(path)
+	if err != nil {
+		return out, err
+	}
+	url, ref, err := fetchArgs(rec)
+	if err != nil {
+		return out, err
+	}
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		lg.Infof("performing shallow 'git clone' of '%s' for repo '%s'", url, rec.Repo)
+		err = runGit(ctx, "", &out, "clone", "--quiet", "--depth", "1", "--", url, dst)
+		if err != nil {
+			os.RemoveAll(dst)
+			return out, err
+		}
+	} else if err := checkoutOf(ctx, dst, url); err != nil {
+		return out, err
+	}
+	if rec.LastCommitId != "" {
+		var head []byte
+		if runGit(ctx, dst, &head, "rev-parse", "HEAD") == nil && strings.TrimSpace(string(head)) == rec.LastCommitId {
+			lg.Debugf("repo '%s' is already at commit '%s'", rec.Repo, rec.LastCommitId)
+			return fetchCheckoutDependencies(ctx, lg, dst, out)
+		}
+	}
+	lg.Infof("performing 'git fetch' of '%s' at '%s' for repo '%s'", url, ref, rec.Repo)
+	err = runGit(ctx, dst, &out, "fetch", "--quiet", "--depth", "1", "--", url, ref)
+	if err != nil {
+		return out, err
+	}
+	err = runGit(ctx, dst, &out, "reset", "--quiet", "--hard", "FETCH_HEAD")
+	if err != nil {
+		return out, err
+	}
+	// nested repos are left alone without a second -f
+	err = runGit(ctx, dst, &out, "clean", "--quiet", "-fd")
+	if err != nil {
+		return out, err
+	}
+	return fetchCheckoutDependencies(ctx, lg, dst, out)
+}
+
+// checkoutOf returns an error unless dir is a git checkout
+// whose origin is url so that a tree ahoy didn't clone, or
+// one of another repo, is never reset and cleaned
+func checkoutOf(ctx context.Context, dir, url string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return fmt.Errorf("'%s' exists but is not a git checkout, remove it to have the repo cloned", dir)
+	}
+	// get-url would apply insteadOf rules, e.g., the one
+	// that adds github_pat, so read the configured URL
+	var origin []byte
+	err := runGit(ctx, dir, &origin, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return fmt.Errorf("'%s' has no origin remote, remove it to have the repo cloned", dir)
+	}
+	if sameRemote(strings.TrimSpace(string(origin)), url) {
+		return nil
+	}
+	return fmt.Errorf("'%s' is a checkout of '%s' rather than '%s', remove it to have the repo cloned", dir, strings.TrimSpace(string(origin)), url)
+}
+
+// sameRemote reports whether the git URLs a and b point at the
+// same repo, ignoring a trailing "/" or ".git"
+func sameRemote(a, b string) bool {
+	trim := func(u string) string {
+		return strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git")
+	}
+	return trim(a) == trim(b)
+}
+
+// fetchCheckoutDependencies fetches the dependencies of the
+// checkout in dst when update_dependencies is set
+func fetchCheckoutDependencies(ctx context.Context, lg *common.Logger, dst string, out []byte) ([]byte, error) {
+	if !conf.UpdateDependencies {
+		return out, nil
+	}
+	deps, err := fetchDependencies(ctx, lg, dst)
+	return append(out, deps...), err
+}
+
+// runGit checks out the job's repo with git and finds its
+// modules in the checkout rather than cloning it again. The
+// modules are part of the checkout so they aren't fetched
+// on their own.
+func (j *repoJob) runGit(ctx context.Context, lg *common.Logger) {
+	j.setRepos(lg)
+	if len(j.repos) == 0 {
+		return
+	}
+	res := fetchRepo(ctx, lg, j.root)
+	if res.err == nil && j.resolve {
+		dir, _ := srcDir(j.root.ImportPath())
+		j.modules, j.resolved = syncModules(lg, &j.root, j.modules, dir)
+		j.setRepos(lg)
+		if len(j.repos) == 0 {
+			// the new module path isn't allowed, the
+			// checkout is removed with the old path
+			return
+		}
+		if newDir, _ := srcDir(j.root.ImportPath()); newDir != dir {
+			lg.Infof("module path of repo '%s' changed, moving '%s' to '%s'", j.root.Repo, dir, newDir)
+			res.err = moveCheckout(dir, newDir)
+			if res.err != nil {
+				res.exitStatus = -1
+			}
+			res.rec = j.root
+		}
+	}
+	j.results = append(j.results, res)
+	for _, mod := range j.repos[1:] {
+		mres := fetchResult{rec: mod, err: res.err, exitStatus: res.exitStatus}
+		if res.err == nil {
+			mres.err = inCheckout(j.root, mod)
+			if mres.err != nil {
+				mres.exitStatus = -1
+			}
+		}
+		j.results = append(j.results, mres)
+	}
+}
+
+// inCheckout returns an error if mod, a module nested in
+// root, isn't laid out at its import path by the checkout
+// of root
+func inCheckout(root, mod registry.Record) error {
+	sub := strings.TrimPrefix(mod.Repo, root.Repo+"/")
+	if mod.ImportPath() != root.ImportPath()+"/"+sub {
+		return fmt.Errorf("module path '%s' is not below the checkout of repo '%s', use fetch_strategy '%s' instead", mod.ImportPath(), root.Repo, fetchModule)
+	}
+	return nil
+}
+
+// moveCheckout moves the checkout in dir to newDir, e.g.,
+// when a repo is first checked out under its name and its
+// go.mod declares a different module path. The checkout is
+// moved aside first since newDir can be below dir.
+func moveCheckout(dir, newDir string) (err error) {
+	if _, err = os.Stat(newDir); err == nil {
+		return fmt.Errorf("can't move the checkout to '%s' which already exists", newDir)
+	}
+	tmp := dir + ".ahoy-move"
+	err = os.Rename(dir, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(newDir), 0755)
+	if err == nil {
+		err = os.Rename(tmp, newDir)
+	}
+	if err != nil {
+		os.Rename(tmp, dir)
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSameRemote(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"https://github.company.com/Org/repo", "https://github.company.com/Org/repo.git", true},
+		{"https://github.company.com/Org/repo/", "https://github.company.com/Org/repo", true},
+		{"https://github.company.com/Org/repo", "https://github.company.com/Org/other", false},
+		{"https://github.company.com/Org/repo", "git@github.company.com:Org/repo.git", false},
+	}
+	for _, tc := range cases {
+		if got := sameRemote(tc.a, tc.b); got != tc.want {
+			t.Errorf("sameRemote(%q, %q) = %t, want %t", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestCheckoutOf(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	const url = "https://github.company.com/Org/repo.git"
+	git := func(dir string, args ...string) {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s %s", args, err, out)
+		}
+	}
+	ctx := context.Background()
+
+	plain := t.TempDir()
+	if err := checkoutOf(ctx, plain, url); err == nil {
+		t.Error("checkoutOf accepted a directory that isn't a git checkout")
+	}
+
+	noOrigin := t.TempDir()
+	git(noOrigin, "init", "--quiet")
+	if err := checkoutOf(ctx, noOrigin, url); err == nil {
+		t.Error("checkoutOf accepted a checkout without an origin")
+	}
+
+	other := t.TempDir()
+	git(other, "init", "--quiet")
+	git(other, "remote", "add", "origin", "https://github.company.com/Org/other.git")
+	if err := checkoutOf(ctx, other, url); err == nil {
+		t.Error("checkoutOf accepted a checkout of another repo")
+	}
+
+	// go get clones without the .git suffix
+	own := filepath.Join(t.TempDir(), "repo")
+	if err := os.Mkdir(own, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(own, "init", "--quiet")
+	git(own, "remote", "add", "origin", "https://github.company.com/Org/repo")
+	if err := checkoutOf(ctx, own, url); err != nil {
+		t.Errorf("checkoutOf rejected a checkout of the repo: %s", err)
+	}
+
+	// like the rule manageGitconfig writes for github_pat
+	git(own, "config", "url.https://TOKEN@github.company.com/.insteadOf", "https://github.company.com/")
+	err := checkoutOf(ctx, own, url)
+	if err != nil {
+		t.Errorf("checkoutOf rejected a checkout of the repo with an insteadOf rule: %s", err)
+	}
+	git(own, "remote", "set-url", "origin", "https://github.company.com/Org/other")
+	err = checkoutOf(ctx, own, url)
+	if err == nil {
+		t.Error("checkoutOf accepted a checkout of another repo with an insteadOf rule")
+	} else if strings.Contains(err.Error(), "TOKEN") {
+		t.Errorf("checkoutOf error leaks the token: %s", err)
+	}
+}
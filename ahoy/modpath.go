@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// resolvedCommits maps each repo to the commit its module
+// path was last resolved at so that modules are only looked
+// for again when the repo changes
+var resolvedCommits = make(map[string]string)
+
+// majorVersionSuffix matches the /vN suffix of modules
+// at major version 2 and above
+var majorVersionSuffix = regexp.MustCompile(`/v[0-9]+$`)
+
+// modulePathFromGoMod returns the path declared by the module
+// directive of a go.mod file or "" if there is none
+func modulePathFromGoMod(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "module" {
+			continue
+		}
+		path := fields[1]
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			path = unquoted
+		}
+		return path
+	}
+	return ""
+}
+
+// cloneURL returns the URL to clone rec from, falling back
+// to https for repos registered without one
+func cloneURL(rec registry.Record) string {
+	if rec.CloneURL != "" {
+		return rec.CloneURL
+	}
+	return "https://" + rec.Repo
+}
+
+// fetchArgs returns the URL and ref to fetch rec from. Both
+// come from hook payloads so they are checked before they
+// are passed to git. The ref is the repo's default branch
+// if it was registered without a commit.
+func fetchArgs(rec registry.Record) (url, ref string, err error) {
+	url = cloneURL(rec)
+	err = registry.CheckCloneURL(url)
+	if err != nil {
+		return url, ref, err
+	}
+	ref = rec.LastCommitId
+	if ref == "" {
+		ref = "HEAD"
+		return url, ref, err
+	}
+	err = registry.CheckCommitId(ref)
+	return url, ref, err
+}
+
+// cloneAt makes a shallow clone of rec at its last commit,
+// or its default branch if it has none, in a new temporary
+// directory which the caller must remove. The clone is
+// stopped if it takes longer than fetch_timeout.
+func cloneAt(ctx context.Context, rec registry.Record) (dir string, err error) {
+	url, ref, err := fetchArgs(rec)
+	if err != nil {
+		return dir, err
+	}
+	dir, err = ioutil.TempDir("", "ahoy-")
+	if err != nil {
+		return dir, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout())
+	defer cancel()
+	var out []byte
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"fetch", "--quiet", "--depth", "1", "--", url, ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	} {
+		err = runGit(ctx, dir, &out, args...)
+		if err != nil {
+			err = fmt.Errorf("clone of '%s' at '%s' failed: %s: %s", url, ref, err.Error(), strings.TrimSpace(string(out)))
+			return dir, err
+		}
+	}
+	return dir, err
+}
+
+// readModulePath reads the module path from the go.mod in
+// dir and checks it against want, the path the module is
+// expected to have. modulePath is empty if there is no go.mod.
+func readModulePath(dir, want string) (modulePath, warning string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if os.IsNotExist(err) {
+		return modulePath, warning, nil
+	}
+	if err != nil {
+		return modulePath, warning, err
+	}
+	modulePath = modulePathFromGoMod(data)
+	if modulePath == "" {
+		warning = "go.mod has no module directive"
+		return modulePath, warning, err
+	}
+	if cerr := checkImportPath(modulePath); cerr != nil {
+		// anyone who can push a go.mod controls this path
+		// so fall back to the repo name rather than use it
+		warning = fmt.Sprintf("go.mod declares an invalid module path: %s", cerr.Error())
+		modulePath = ""
+		return modulePath, warning, err
+	}
+	if majorVersionSuffix.ReplaceAllString(modulePath, "") != want {
+		warning = fmt.Sprintf("go.mod declares module '%s' but the repo is registered as '%s'", modulePath, want)
+	}
+	return modulePath, warning, err
+}
+
+// findModules returns the directories below root, relative
+// to it, that hold a go.mod. Directories the go tool ignores
+// (vendor, testdata and those starting with . or _) are
+// skipped.
+func findModules(root string) (dirs []string, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path != root && (name == "vendor" || name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != "go.mod" {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			dirs = append(dirs, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// inNestedRepo reports whether the directory sub of the
+// checkout in root is part of a different git checkout
+func inNestedRepo(root, sub string) bool {
+	dir := root
+	for _, elem := range strings.Split(sub, "/") {
+		dir = filepath.Join(dir, elem)
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveModules reads the module path of the root go.mod in
+// dir, a checkout of rec at its last commit. Every nested
+// go.mod is returned as a child module of rec named after
+// the directory it's in, e.g., github.company.com/Org/mono/api.
+func resolveModules(dir string, rec registry.Record) (root registry.Record, modules []registry.Record, err error) {
+	root = rec
+	repo := strings.TrimSuffix(rec.Repo, ".git")
+	root.ModulePath, root.Warning, err = readModulePath(dir, repo)
+	if err != nil {
+		return root, modules, err
+	}
+	subdirs, err := findModules(dir)
+	if err != nil {
+		return root, modules, err
+	}
+	for _, sub := range subdirs {
+		if inNestedRepo(dir, sub) {
+			// another repo checked out inside this one
+			continue
+		}
+		mod := registry.Record{
+			Repo:              rec.Repo + "/" + sub,
+			LastCommitId:      rec.LastCommitId,
+			LastCommitMessage: rec.LastCommitMessage,
+			LastCommitUser:    rec.LastCommitUser,
+			CloneURL:          rec.CloneURL,
+			Parent:            rec.Repo,
+		}
+		// nested modules are expected below the root
+		// module's path if it has one
+		want := repo + "/" + sub
+		if root.ModulePath != "" {
+			want = majorVersionSuffix.ReplaceAllString(root.ModulePath, "") + "/" + sub
+		}
+		mod.ModulePath, mod.Warning, err = readModulePath(filepath.Join(dir, sub), want)
+		if err != nil {
+			return root, modules, err
+		}
+		modules = append(modules, mod)
+	}
+	return root, modules, err
+}
+
+// syncModules resolves the module path and nested modules
+// of rec from dir, a checkout of rec at its last commit, and
+// stores them in the registry. registered are the modules
+// already stored as children of rec and are returned as is
+// if they can't be resolved.
+func syncModules(lg *common.Logger, rec *registry.Record, registered []registry.Record, dir string) (modules []registry.Record, ok bool) {
+	root, modules, err := resolveModules(dir, *rec)
+	if err != nil {
+		lg.Errorf("unable to resolve modules for repo '%s': %s", rec.Repo, err.Error())
+		return registered, false
+	}
+	for _, mod := range append([]registry.Record{root}, modules...) {
+		if mod.Warning != "" {
+			lg.Warnf("repo '%s': %s", mod.Repo, mod.Warning)
+		}
+	}
+	if root.ModulePath != rec.ModulePath || root.Warning != rec.Warning {
+		for attribute, value := range map[string]string{
+			"modulePath": root.ModulePath,
+			"warning":    root.Warning,
+		} {
+			err = reg.SetRepoAttribute(rec.Repo, attribute, value)
+			if err != nil {
+				lg.Errorf("unable to store %s for repo '%s': %s", attribute, rec.Repo, err.Error())
+			}
+		}
+		rec.ModulePath = root.ModulePath
+		rec.Warning = root.Warning
+	}
+	previous := make(map[string]registry.Record)
+	for _, mod := range registered {
+		previous[mod.Repo] = mod
+	}
+	found := make(map[string]bool)
+	for _, mod := range modules {
+		found[mod.Repo] = true
+		lg.Infof("registering module '%s' of repo '%s'", mod.Repo, rec.Repo)
+		err = reg.PutRepo(mod)
+		if err != nil {
+			lg.Errorf("unable to register module '%s': %s", mod.Repo, err.Error())
+		}
+		if mod.Warning == "" && previous[mod.Repo].Warning != "" {
+			// putRepo only sets fields that have a
+			// value so clear the old warning here
+			err = reg.SetRepoAttribute(mod.Repo, "warning", "")
+			if err != nil {
+				lg.Errorf("unable to clear warning for module '%s': %s", mod.Repo, err.Error())
+			}
+		}
+	}
+	for _, mod := range registered {
+		if found[mod.Repo] {
+			continue
+		}
+		lg.Infof("module '%s' is gone from repo '%s', removing", mod.Repo, rec.Repo)
+		err = reg.DeleteRepo(mod.Repo)
+		if err != nil {
+			lg.Errorf("unable to remove module '%s': %s", mod.Repo, err.Error())
+		}
+	}
+	return modules, true
+}
+
+// checkImportPath returns an error if path is not a valid
+// import path like golang.org/x/mod/module.CheckImportPath
+// does. Paths are used as directories below $GOPATH/src so
+// this keeps them from pointing anywhere else.
+func checkImportPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("empty import path")
+	}
+	if strings.HasPrefix(path, "-") {
+		return fmt.Errorf("import path '%s' begins with a dash", path)
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == "" {
+			return fmt.Errorf("import path '%s' has a leading, trailing or double slash", path)
+		}
+		if elem[0] == '.' || elem[len(elem)-1] == '.' {
+			return fmt.Errorf("import path '%s' has an element that begins or ends with a dot", path)
+		}
+		for _, r := range elem {
+			if !importPathRuneOK(r) {
+				return fmt.Errorf("import path '%s' contains invalid character %q", path, r)
+			}
+		}
+	}
+	return nil
+}
+
+// importPathRuneOK reports whether r can appear in
+// an element of an import path
+func importPathRuneOK(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' ||
+		strings.ContainsRune("-._~+", r)
+}
+
+// checkRepoRules applies the repo rules to both the name of
+// rec and the module path its go.mod declares since either
+// decides what gets fetched
+func checkRepoRules(rec registry.Record) error {
+	err := conf.repoRules.Check(rec.Repo)
+	if err == nil && rec.ModulePath != "" && rec.ModulePath != rec.Repo {
+		err = conf.repoRules.Check(rec.ModulePath)
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+func TestCheckImportPath(t *testing.T) {
+	valid := []string{
+		"github.company.com/Org/repo",
+		"github.company.com/Org/repo/v2",
+		"bitbucket.company.com/scm/proj/repo.git",
+		"example.com/a-b_c~d+e",
+	}
+	for _, path := range valid {
+		if err := checkImportPath(path); err != nil {
+			t.Errorf("checkImportPath(%q) = %v, want nil", path, err)
+		}
+	}
+	invalid := []string{
+		"",
+		"../../../../home/x",
+		"example.com/../../x",
+		"example.com/./x",
+		"/etc/passwd",
+		"example.com//x",
+		"example.com/x/",
+		"example.com/.hidden",
+		"example.com/x.",
+		`example.com\x`,
+		"example.com/a b",
+		"-example.com/x",
+	}
+	for _, path := range invalid {
+		if err := checkImportPath(path); err == nil {
+			t.Errorf("checkImportPath(%q) = nil, want an error", path)
+		}
+	}
+}
+
+func TestSrcDir(t *testing.T) {
+	conf = &config{GoGetEnvs: []string{"GOPATH=/srv/gopath"}}
+	dir, err := srcDir("github.company.com/Org/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.FromSlash("/srv/gopath/src/github.company.com/Org/repo"); dir != want {
+		t.Errorf("srcDir = %q, want %q", dir, want)
+	}
+	for _, path := range []string{"../x", "a/../../x", "/abs"} {
+		if dir, err := srcDir(path); err == nil {
+			t.Errorf("srcDir(%q) = %q, want an error", path, dir)
+		}
+	}
+}
+
+func TestReadModulePath(t *testing.T) {
+	cases := []struct {
+		gomod       string
+		wantPath    string
+		wantWarning bool
+	}{
+		{"module github.company.com/Org/repo\n", "github.company.com/Org/repo", false},
+		{"module \"github.company.com/Org/repo/v2\"\n", "github.company.com/Org/repo/v2", false},
+		{"module vanity.company.com/repo\n", "vanity.company.com/repo", true},
+		{"module ../../../../home/x\n", "", true},
+		{"go 1.20\n", "", true},
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(tc.gomod), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, warning, err := readModulePath(dir, "github.company.com/Org/repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != tc.wantPath || (warning != "") != tc.wantWarning {
+			t.Errorf("readModulePath(%q) = %q, %q", tc.gomod, path, warning)
+		}
+	}
+}
+
+func TestCheckRepoRules(t *testing.T) {
+	rules, err := common.NewRepoRules([]string{"github.company.com/Org/*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf = &config{repoRules: rules}
+	cases := []struct {
+		rec  registry.Record
+		want bool
+	}{
+		{registry.Record{Repo: "github.company.com/Org/repo"}, true},
+		{registry.Record{Repo: "github.company.com/Org/repo", ModulePath: "github.company.com/Org/renamed"}, true},
+		{registry.Record{Repo: "github.company.com/Org/repo", ModulePath: "github.com/someone/else"}, false},
+		{registry.Record{Repo: "github.company.com/Other/repo"}, false},
+	}
+	for _, tc := range cases {
+		if got := checkRepoRules(tc.rec) == nil; got != tc.want {
+			t.Errorf("checkRepoRules(%+v) allowed = %t, want %t", tc.rec, got, tc.want)
+		}
+	}
+}
+
+func TestFetchArgs(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	cases := []struct {
+		rec     registry.Record
+		wantRef string
+		wantErr bool
+	}{
+		{registry.Record{Repo: "github.company.com/Org/repo", LastCommitId: sha}, sha, false},
+		{registry.Record{Repo: "github.company.com/Org/repo"}, "HEAD", false},
+		{registry.Record{Repo: "github.company.com/Org/repo", LastCommitId: "--upload-pack=touch /tmp/pwned"}, "", true},
+		{registry.Record{Repo: "github.company.com/Org/repo", CloneURL: "--upload-pack=touch /tmp/pwned"}, "", true},
+		{registry.Record{Repo: "github.company.com/Org/repo", CloneURL: "ext::sh -c touch% /tmp/pwned"}, "", true},
+	}
+	for _, tc := range cases {
+		_, ref, err := fetchArgs(tc.rec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("fetchArgs(%+v) error = %v, want error %t", tc.rec, err, tc.wantErr)
+			continue
+		}
+		if err == nil && ref != tc.wantRef {
+			t.Errorf("fetchArgs(%+v) ref = %q, want %q", tc.rec, ref, tc.wantRef)
+		}
+	}
+}
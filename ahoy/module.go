@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// supported values for the fetch_strategy config directive
+const (
+	fetchGoGet  = "goget"
+	fetchModule = "module"
+	fetchGit    = "git"
+)
+
+// treeMu serializes changes to the tree under $GOPATH/src
+// so that concurrent fetches of a repo and the modules
+// nested in it don't swap directories out from under
+// each other
+var treeMu sync.Mutex
+
+// gopath returns the GOPATH set in go_get_envs which is
+// where the fetched repos are laid out
+func (c *config) gopath() (gopath string, err error) {
+	for _, env := range c.GoGetEnvs {
+		chunked := strings.SplitN(env, "=", 2)
+		if len(chunked) == 2 && chunked[0] == "GOPATH" {
+			gopath = chunked[1]
+		}
+	}
+	if gopath == "" {
+		err = errors.New("GOPATH env var empty unable to determine where to put repos")
+	}
+	return gopath, err
+}
+
+// srcDir returns the directory below $GOPATH/src that the
+// repo with import path path is laid out in. It returns an
+// error for paths that would end up anywhere else.
+func srcDir(path string) (dir string, err error) {
+	gp, err := conf.gopath()
+	if err != nil {
+		return dir, err
+	}
+	if err = checkImportPath(path); err != nil {
+		return dir, err
+	}
+	src := filepath.Join(gp, "src")
+	dir = filepath.Join(src, filepath.FromSlash(path))
+	rel, err := filepath.Rel(src, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		err = fmt.Errorf("'%s' is not below '%s'", dir, src)
+	}
+	return dir, err
+}
+
+// downloadModule downloads the module of rec at its last
+// commit with 'go mod download' and copies it to its import
+// path under $GOPATH/src. Unlike 'go get' this works on Go
+// releases that no longer support GOPATH mode. Only the
+// module itself is downloaded, not its dependencies.
+func downloadModule(ctx context.Context, lg *common.Logger, rec registry.Record) (out []byte, err error) {
+	path := rec.ImportPath()
+	dst, err := srcDir(path)
+	if err != nil {
+		return out, err
+	}
+	version := rec.LastCommitId
+	if version == "" {
+		// registered without a push, e.g.,
+		// through the admin API
+		version = "latest"
+	}
+	lg.Infof("performing 'go mod download %s@%s' for repo '%s'", path, version, rec.Repo)
+	cmd := newCommand(ctx, goBinary(), "mod", "download", "-json", path+"@"+version)
+	// run outside of any module and make sure module mode
+	// is on whatever go_get_envs says
+	cmd.Dir = os.TempDir()
+	cmd.Env = append(goEnv(), "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	out = append(stdout.Bytes(), stderr.Bytes()...)
+	var info moduleInfo
+	jerr := json.Unmarshal(stdout.Bytes(), &info)
+	if err != nil {
+		if info.Error != "" {
+			err = fmt.Errorf("%w: %s", err, info.Error)
+		}
+		return out, err
+	}
+	if jerr != nil {
+		return out, fmt.Errorf("unable to parse 'go mod download' output: %s", jerr.Error())
+	}
+	err = replaceTree(info.Dir, dst)
+	if err != nil || !conf.UpdateDependencies {
+		return out, err
+	}
+	deps, err := fetchDependencies(ctx, lg, dst)
+	return append(out, deps...), err
+}
+
+// moduleInfo is the part of the 'go mod download -json'
+// output ahoy uses
+type moduleInfo struct {
+	Path    string
+	Version string
+	Dir     string
+	Error   string
+}
+
+// registeredPaths holds the import paths of every registered
+// repo and module. It is set before each sync's fetches start.
+var registeredPaths map[string]bool
+
+// isRegisteredPath returns whether path is a registered
+// repo or module or is a package below one
+func isRegisteredPath(path string) bool {
+	for {
+		if registeredPaths[path] {
+			return true
+		}
+		i := strings.LastIndex(path, "/")
+		if i < 0 {
+			return false
+		}
+		path = path[:i]
+	}
+}
+
+// fetchDependencies downloads the modules that the module in
+// dir depends on and copies each to its import path under
+// $GOPATH/src. Registered repos are left alone since they
+// are fetched at the commit chook recorded for them.
+func fetchDependencies(ctx context.Context, lg *common.Logger, dir string) (out []byte, err error) {
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err != nil {
+		// nothing to resolve dependencies from
+		return out, nil
+	}
+	lg.Infof("performing 'go mod download all' for dependencies of '%s'", dir)
+	cmd := newCommand(ctx, goBinary(), "mod", "download", "-json", "all")
+	cmd.Dir = dir
+	cmd.Env = append(goEnv(), "GO111MODULE=on", "GOFLAGS=-mod=mod")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	out = stderr.Bytes()
+	// copy whatever was downloaded even if some
+	// of the dependencies failed
+	dec := json.NewDecoder(&stdout)
+	for {
+		var info moduleInfo
+		if dec.Decode(&info) != nil {
+			break
+		}
+		if info.Error != "" {
+			out = append(out, fmt.Sprintf("%s@%s: %s\n", info.Path, info.Version, info.Error)...)
+			continue
+		}
+		if info.Dir == "" || isRegisteredPath(info.Path) {
+			continue
+		}
+		lg.Debugf("copying dependency '%s@%s'", info.Path, info.Version)
+		dst, cerr := srcDir(info.Path)
+		if cerr == nil {
+			cerr = replaceTree(info.Dir, dst)
+		}
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return out, err
+}
+
+// replaceTree makes dst a writable copy of src. Directories
+// of the old dst holding a go.mod belong to nested modules
+// that are fetched separately so they are moved over to the
+// new copy.
+func replaceTree(src, dst string) (err error) {
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	// jobs sharing a dependency copy it at the same time so
+	// each gets its own temporary copy, hidden from the go tool
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".ahoy-new-")
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp, 0755)
+	if err == nil {
+		err = copyTree(src, tmp)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	treeMu.Lock()
+	defer treeMu.Unlock()
+	old := dst + ".ahoy-old"
+	os.RemoveAll(old)
+	if _, err := os.Stat(dst); err == nil {
+		err = os.Rename(dst, old)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Rename(old, dst)
+		os.RemoveAll(tmp)
+		return err
+	}
+	nested, err := findModules(old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range nested {
+		from := filepath.Join(old, filepath.FromSlash(dir))
+		to := filepath.Join(dst, filepath.FromSlash(dir))
+		if _, err := os.Stat(from); err != nil {
+			// moved along with a module it is nested in
+			continue
+		}
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(to), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(from, to)
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(old)
+}
+
+// copyTree copies the files of src to dst. Files in the
+// module cache are read-only so the copies are made
+// writable for the next sync to replace.
+func copyTree(src, dst string) (err error) {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm()|0200)
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
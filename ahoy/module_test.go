@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// writeFiles creates the files in dir with the given contents
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplaceTree(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "src", "example.com", "dep")
+	// the nested module is fetched on its own and has
+	// to survive the parent being replaced
+	writeFiles(t, dst, map[string]string{"old.go": "package dep\n", "api/go.mod": "module example.com/dep/api\n"})
+	const copies = 8
+	var wg sync.WaitGroup
+	for i := 0; i < copies; i++ {
+		src := filepath.Join(dir, fmt.Sprintf("cache%d", i))
+		writeFiles(t, src, map[string]string{"go.mod": "module example.com/dep\n", "dep.go": fmt.Sprintf("package dep // %d\n", i)})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := replaceTree(src, dst); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, name := range []string{"go.mod", "dep.go", "api/go.mod"} {
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s is missing after the concurrent copies: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old.go")); err == nil {
+		t.Error("old.go was kept")
+	}
+	// the copies are writable so the next sync can replace them
+	if err := ioutil.WriteFile(filepath.Join(dst, "dep.go"), nil, 0644); err != nil {
+		t.Error(err)
+	}
+	left, err := ioutil.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 {
+		var names []string
+		for _, fi := range left {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("temporary copies left behind: %v", names)
+	}
+}
+
+func TestDownloadModule(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	dir := t.TempDir()
+	// stands in for the module cache which is read-only
+	cache := filepath.Join(dir, "cache")
+	writeFiles(t, cache, map[string]string{"go.mod": "module example.com/foo\n", "foo.go": "package foo\n"})
+	bin, logFile := fakeGo(t, `case "$4" in
+example.com/missing@*) echo '{"Path":"example.com/missing","Error":"not found"}'; exit 1;;
+esac
+echo '{"Path":"example.com/foo","Version":"v0.0.0","Dir":"`+cache+`"}'`)
+	gopath := filepath.Join(dir, "gopath")
+	conf = &config{FetchStrategy: fetchModule, FetchTimeout: 60, GoBinaryPath: bin, GoGetEnvs: []string{"GOPATH=" + gopath}}
+	cases := []struct {
+		name     string
+		rec      registry.Record
+		wantArg  string
+		wantErr  string
+		wantExit int
+	}{
+		{"at the pushed commit", registry.Record{Repo: "example.com/foo", LastCommitId: sha}, "example.com/foo@" + sha, "", 0},
+		{"registered without a push", registry.Record{Repo: "example.com/foo"}, "example.com/foo@latest", "", 0},
+		{"vanity module path", registry.Record{Repo: "github.company.com/Org/foo", ModulePath: "example.com/foo", LastCommitId: sha}, "example.com/foo@" + sha, "", 0},
+		{"missing module", registry.Record{Repo: "example.com/missing", LastCommitId: sha}, "example.com/missing@" + sha, "not found", 1},
+	}
+	for _, tc := range cases {
+		res := fetchRepo(context.Background(), log, tc.rec)
+		if got := strings.Join(fakeGoCalls(t, logFile), " "); got != tc.wantArg {
+			t.Errorf("%s: downloaded %q, want %q", tc.name, got, tc.wantArg)
+		}
+		if tc.wantErr != "" {
+			if res.err == nil || !strings.Contains(res.err.Error(), tc.wantErr) || res.exitStatus != tc.wantExit {
+				t.Errorf("%s: err = %v exit status = %d, want %q and %d", tc.name, res.err, res.exitStatus, tc.wantErr, tc.wantExit)
+			}
+			if _, err := os.Stat(filepath.Join(gopath, "src", tc.rec.Repo)); err == nil {
+				t.Errorf("%s: failed download left a copy behind", tc.name)
+			}
+			continue
+		}
+		if res.err != nil {
+			t.Errorf("%s: err = %v: %s", tc.name, res.err, res.output)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(gopath, "src", "example.com", "foo", "foo.go")); err != nil {
+			t.Errorf("%s: module wasn't copied to its import path: %s", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// reg is the registry selected by the backend config
+// directive and is set up in main(). ahoy only needs the
+// repos so it can't bump the trigger by accident.
+var reg registry.Repos
+
+// newRegistry returns the registry for the backend
+// configured in c
+func newRegistry(c *config) (registry.Repos, error) {
+	switch c.Backend {
+	case registry.BackendDynamoDB:
+		return registry.NewDynamo(c.DynamoDBRegion, c.DynamoDBTable, c.DynamoDBTriggerKey)
+	case registry.BackendLocal:
+		return registry.NewBolt(c.LocalDBPath), nil
+	}
+	return nil, fmt.Errorf("unknown backend '%s'", c.Backend)
+}
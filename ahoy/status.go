@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rendicott/goarder/internal/common"
+)
+
+// statusPath is where the sync state is served as JSON
+const statusPath = "/status"
+
+var (
+	syncCyclesTotal = common.NewCounterVec("ahoy_sync_cycles_total",
+		"Sync cycles run by outcome.",
+		"outcome")
+	fetchDuration = common.NewGaugeVec("ahoy_fetch_duration_seconds",
+		"Duration of the last fetch of each repo by fetch strategy.",
+		"repo", "strategy")
+	fetchExitStatus = common.NewGaugeVec("ahoy_fetch_exit_status",
+		"Exit status of the last fetch of each repo by fetch strategy, -1 if it could not be run.",
+		"repo", "strategy")
+	reposOnDisk = common.NewGaugeVec("ahoy_repos_on_disk",
+		"Repos fetched to the local GOPATH.")
+	lastSuccessfulSync = common.NewGaugeVec("ahoy_last_successful_sync_timestamp_seconds",
+		"Unix time the last sync cycle finished without an error.")
+	localCounter = common.NewGaugeVec("ahoy_counter",
+		"Trigger count the local repos were last synced at.")
+	remoteTrigger = common.NewGaugeVec("ahoy_trigger",
+		"Trigger count last read from the registry.")
+)
+
+// syncState is what ahoy knows about its syncs and is
+// shared with the status server
+type syncState struct {
+	sync.Mutex
+	counter    int
+	trigger    int
+	localRepos []string
+	lastErrors map[string]string
+	commits    map[string]string
+	lastSync   time.Time
+}
+
+var state = &syncState{
+	lastErrors: make(map[string]string),
+	commits:    make(map[string]string),
+}
+
+func (s *syncState) setTrigger(trigger int) {
+	s.Lock()
+	defer s.Unlock()
+	s.trigger = trigger
+	remoteTrigger.Set(float64(trigger))
+}
+
+func (s *syncState) setCounter(counter int) {
+	s.Lock()
+	defer s.Unlock()
+	s.counter = counter
+	localCounter.Set(float64(counter))
+}
+
+// setLocalRepos records which repos are on disk and drops
+// what is known about any others
+func (s *syncState) setLocalRepos(repos []string) {
+	s.Lock()
+	defer s.Unlock()
+	s.localRepos = append([]string{}, repos...)
+	current := make(map[string]bool)
+	for _, repo := range repos {
+		current[repo] = true
+	}
+	for repo := range s.lastErrors {
+		if !current[repo] {
+			delete(s.lastErrors, repo)
+			delete(s.commits, repo)
+			fetchDuration.Remove(repo, conf.FetchStrategy)
+			fetchExitStatus.Remove(repo, conf.FetchStrategy)
+		}
+	}
+	reposOnDisk.Set(float64(len(repos)))
+}
+
+// recordFetch records the outcome of a fetch of repo
+// at commit
+func (s *syncState) recordFetch(repo, commit string, duration time.Duration, exitStatus int, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastErrors[repo] = ""
+	if err != nil {
+		s.lastErrors[repo] = err.Error()
+	} else {
+		s.commits[repo] = commit
+	}
+	fetchDuration.Set(duration.Seconds(), repo, conf.FetchStrategy)
+	fetchExitStatus.Set(float64(exitStatus), repo, conf.FetchStrategy)
+}
+
+// recordSync records the outcome of a sync cycle
+func (s *syncState) recordSync(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		syncCyclesTotal.Inc("error")
+		return
+	}
+	syncCyclesTotal.Inc("success")
+	s.lastSync = time.Now()
+	lastSuccessfulSync.Set(float64(s.lastSync.Unix()))
+}
+
+// repoStatus is the state of a single repo
+type repoStatus struct {
+	LastError string `json:"lastError"`
+	// Commit is the commit the repo was last
+	// fetched at successfully
+	Commit string `json:"commit,omitempty"`
+}
+
+// statusResponse is the body served on statusPath
+type statusResponse struct {
+	Counter            int                   `json:"counter"`
+	Trigger            int                   `json:"trigger"`
+	LocalRepos         []string              `json:"localRepos"`
+	Repos              map[string]repoStatus `json:"repos"`
+	LastSuccessfulSync string                `json:"lastSuccessfulSync,omitempty"`
+}
+
+func handlerStatus(w http.ResponseWriter, r *http.Request) {
+	state.Lock()
+	resp := statusResponse{
+		Counter:    state.counter,
+		Trigger:    state.trigger,
+		LocalRepos: append([]string{}, state.localRepos...),
+		Repos:      make(map[string]repoStatus),
+	}
+	for repo, lastError := range state.lastErrors {
+		resp.Repos[repo] = repoStatus{LastError: lastError, Commit: state.commits[repo]}
+	}
+	if !state.lastSync.IsZero() {
+		resp.LastSuccessfulSync = state.lastSync.UTC().Format(time.RFC3339)
+	}
+	state.Unlock()
+	sort.Strings(resp.LocalRepos)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Errorf("Error writing status response: %s", err.Error())
+	}
+}
+
+// serveStatus serves metrics and status on addr and
+// exits if it can't listen there
+func serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(common.MetricsPath, common.HandlerMetrics)
+	mux.HandleFunc(statusPath, handlerStatus)
+	log.Infof("serving %s and %s on %s", common.MetricsPath, statusPath, addr)
+	err := http.ListenAndServe(addr, mux)
+	log.Errorf("Fatal error, status server stopped: %s", err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rendicott/goarder/internal/common"
+)
+
+func TestFetchMetrics(t *testing.T) {
+	conf = &config{FetchStrategy: fetchGit}
+	state.recordFetch("example.com/ok", "abc", 2*time.Second, 0, nil)
+	state.recordFetch("example.com/gone", "abc", time.Second, 1, errors.New("exit status 1"))
+	state.setLocalRepos([]string{"example.com/ok"})
+	w := httptest.NewRecorder()
+	common.HandlerMetrics(w, httptest.NewRequest("GET", common.MetricsPath, nil))
+	body := w.Body.String()
+	cases := []struct {
+		line string
+		want bool
+	}{
+		{`ahoy_fetch_duration_seconds{repo="example.com/ok",strategy="git"} 2`, true},
+		{`ahoy_fetch_exit_status{repo="example.com/ok",strategy="git"} 0`, true},
+		// repos that are no longer on disk are dropped
+		{`ahoy_fetch_exit_status{repo="example.com/gone",strategy="git"}`, false},
+		{"ahoy_go_get_", false},
+	}
+	for _, tc := range cases {
+		if got := strings.Contains(body, tc.line); got != tc.want {
+			t.Errorf("metrics contain %q = %t, want %t", tc.line, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// apiResyncPath is the path of the admin resync endpoint
+const apiResyncPath = "/api/resync"
+
+// adminRequest is the body of POST /api/repos. Repo is
+// optional and overrides the name derived from CloneURL.
+type adminRequest struct {
+	CloneURL string `json:"clone_url"`
+	Repo     string `json:"repo"`
+}
+
+// adminResponse describes what an admin request did
+type adminResponse struct {
+	Repo    string `json:"repo,omitempty"`
+	Action  string `json:"action"`
+	Trigger int    `json:"trigger"`
+}
+
+// requireAdmin checks the bearer token of r against the
+// configured admin tokens and writes an error to w if it
+// is not valid. The admin API is disabled if no tokens
+// are configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if len(conf.AdminTokens) == 0 {
+		writeJSONError(w, http.StatusForbidden, "admin API is disabled, set admin_tokens to enable it")
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != "" {
+		for _, t := range conf.AdminTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="chook"`)
+	writeJSONError(w, http.StatusUnauthorized, "missing or invalid admin token")
+	reqLog(w).Warnf("Rejecting admin request %s %s: invalid token", r.Method, r.URL.Path)
+	return false
+}
+
+// repoFromCloneURL derives the go get repo name from an
+// https or scp style ssh clone URL, e.g., both
+// https://github.company.com/Org/myrepo.git and
+// git@github.company.com:Org/myrepo.git give
+// github.company.com/Org/myrepo. The name is derived by
+// setRepo like it is for hooks so a repo registered either
+// way ends up under the same key. Bitbucket Server hooks
+// name repos after their /scm/ clone URL which keeps the
+// .git suffix so it is kept for those here too.
+func repoFromCloneURL(cloneURL string) (repo string, err error) {
+	u := strings.TrimSpace(cloneURL)
+	if !strings.Contains(u, "://") {
+		if at := strings.Index(u, "@"); at >= 0 {
+			// scp style, e.g., git@host:Org/repo.git
+			u = "ssh://" + strings.Replace(u, ":", "/", 1)
+		} else {
+			u = "https://" + u
+		}
+	}
+	u = strings.TrimSuffix(u, "/")
+	if !strings.Contains(u, "/scm/") {
+		u = strings.TrimSuffix(u, ".git")
+	}
+	var rec registry.Record
+	err = setRepo(&rec, u)
+	if err != nil {
+		err = fmt.Errorf("could not derive repo name from clone URL '%s'", cloneURL)
+		return repo, err
+	}
+	return rec.Repo, err
+}
+
+// handlerAPIRegister serves POST /api/repos which registers
+// the repo in the request body and bumps the trigger
+func handlerAPIRegister(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req adminRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "could not parse request body")
+		return
+	}
+	rec := registry.Record{Repo: req.Repo, CloneURL: req.CloneURL}
+	if rec.Repo != "" {
+		err = checkRepoName(rec.Repo)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		rec.Repo, err = repoFromCloneURL(req.CloneURL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	err = checkRecord(rec)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = conf.repoRules.Check(rec.Repo)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		reqLog(w).Warnf("Rejecting admin registration: %s", err.Error())
+		return
+	}
+	_, err = reg.GetRepo(rec.Repo)
+	if err == nil {
+		count, err := reg.GetTrigger()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error retrieving trigger value")
+			reqLog(w).Errorf("error retrieving trigger value: %s", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, adminResponse{Repo: rec.Repo, Action: "unchanged", Trigger: count})
+		return
+	}
+	if err != registry.ErrRepoNotRegistered {
+		writeJSONError(w, http.StatusInternalServerError, "error retrieving repo")
+		reqLog(w).Errorf("error retrieving repo: %s", err.Error())
+		return
+	}
+	err = writeRegistry(&rec, "create")
+	if err == errTriggerKeyProtected {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "registry create error")
+		reqLog(w).Errorf("registry create error: %s", err.Error())
+		return
+	}
+	reqLog(w).Infof("admin API registered repo '%s'", rec.Repo)
+	adminBumpTrigger(w, http.StatusCreated, rec.Repo, "created")
+}
+
+// handlerAPIDelete serves DELETE /api/repos/{repo} which
+// removes the repo and bumps the trigger
+func handlerAPIDelete(w http.ResponseWriter, r *http.Request, repo string) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	rec, err := reg.GetRepo(repo)
+	if err == registry.ErrRepoNotRegistered {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("repo '%s' is not registered", repo))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error retrieving repo")
+		reqLog(w).Errorf("error retrieving repo: %s", err.Error())
+		return
+	}
+	err = writeRegistry(&rec, "delete")
+	if err == errTriggerKeyProtected {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "registry delete error")
+		reqLog(w).Errorf("registry delete error: %s", err.Error())
+		return
+	}
+	reqLog(w).Infof("admin API deleted repo '%s'", rec.Repo)
+	adminBumpTrigger(w, http.StatusOK, rec.Repo, "deleted")
+}
+
+// handlerAPIResync serves POST /api/resync which bumps the
+// trigger so that ahoy resyncs every repo
+func handlerAPIResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	reqLog(w).Infof("admin API requested resync")
+	adminBumpTrigger(w, http.StatusOK, "", "resync")
+}
+
+// adminBumpTrigger bumps the trigger and writes the
+// outcome of an admin request to w
+func adminBumpTrigger(w http.ResponseWriter, code int, repo, action string) {
+	count, err := reg.BumpTrigger()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error updating trigger value")
+		reqLog(w).Errorf("error updating trigger value: %s", err.Error())
+		return
+	}
+	reqLog(w).Infof("Updated trigger count to %d", count)
+	writeJSON(w, code, adminResponse{Repo: repo, Action: action, Trigger: count})
+}
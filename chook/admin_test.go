@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+func TestAdminRegister(t *testing.T) {
+	rules, err := common.NewRepoRules(nil, []string{"github.company.com/Denied/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf = &config{DynamoDBtriggerKey: "00000trigger", AdminTokens: []string{"secret"}, repoRules: rules}
+	reg = registry.NewBolt(filepath.Join(t.TempDir(), "registry.db"))
+	cases := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"no token", "", `{"clone_url":"https://github.company.com/Org/repo.git"}`, http.StatusUnauthorized},
+		{"denied repo", "secret", `{"clone_url":"https://github.company.com/Denied/repo.git"}`, http.StatusForbidden},
+		{"denied repo by name", "secret", `{"repo":"github.company.com/Denied/repo"}`, http.StatusForbidden},
+		{"option as clone URL", "secret", `{"repo":"github.company.com/Org/repo","clone_url":"--upload-pack=touch /tmp/pwned"}`, http.StatusBadRequest},
+		{"allowed repo", "secret", `{"clone_url":"https://github.company.com/Org/repo.git"}`, http.StatusCreated},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, apiReposPath, strings.NewReader(tc.body))
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handlerAPIRepos(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d: %s", tc.name, w.Code, tc.want, w.Body.String())
+		}
+	}
+	if _, err := reg.GetRepo("github.company.com/Denied/repo"); err != registry.ErrRepoNotRegistered {
+		t.Errorf("denied repo was registered: %v", err)
+	}
+}
+
+func TestAPIQueueNeedsAdmin(t *testing.T) {
+	conf = &config{AdminTokens: []string{"secret"}}
+	cases := []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		// authorized but the queue isn't enabled
+		{"secret", http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, apiQueuePath, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handlerAPIQueue(w, r)
+		if w.Code != tc.want {
+			t.Errorf("token %q: status = %d, want %d", tc.token, w.Code, tc.want)
+		}
+	}
+}
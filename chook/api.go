@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// apiReposPath is the base path of the repos API
+const apiReposPath = "/api/repos"
+
+// default and maximum page sizes for listing repos
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiRepo is a single repo as returned by the API
+type apiRepo struct {
+	registry.Record
+	Trigger int `json:"trigger"`
+}
+
+// apiRepoList is a page of repos as returned by the API. Next
+// is the value to pass as "after" to get the following page
+// and is empty on the last page.
+type apiRepoList struct {
+	Repos   []registry.Record `json:"repos"`
+	Trigger int               `json:"trigger"`
+	Next    string            `json:"next,omitempty"`
+}
+
+// apiError is the body of every error returned by the API
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v to w as JSON with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		reqLog(w).Errorf("Error writing API response: %s", err.Error())
+	}
+}
+
+// writeJSONError writes msg to w as an apiError
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, apiError{Error: msg})
+}
+
+// handlerAPIRepos serves GET /api/repos which lists registered
+// repos. Supported query parameters are:
+//
+//	prefix  only return repos starting with this (e.g., host/org)
+//	limit   maximum number of repos to return
+//	after   only return repos sorted after this repo (see next)
+//
+// POST /api/repos registers a repo, see handlerAPIRegister.
+func handlerAPIRepos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		handlerAPIRegister(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	q := r.URL.Query()
+	limit := apiDefaultLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	if limit > apiMaxLimit {
+		limit = apiMaxLimit
+	}
+	prefix := q.Get("prefix")
+	after := q.Get("after")
+
+	recs, err := reg.ListRepos()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error listing repos")
+		reqLog(w).Errorf("Error listing repos: %s", err.Error())
+		return
+	}
+	count, err := reg.GetTrigger()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error retrieving trigger value")
+		reqLog(w).Errorf("Error retrieving trigger value: %s", err.Error())
+		return
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Repo < recs[j].Repo
+	})
+	list := apiRepoList{
+		Repos:   []registry.Record{},
+		Trigger: count,
+	}
+	for _, rec := range recs {
+		if !strings.HasPrefix(rec.Repo, prefix) || rec.Repo <= after {
+			continue
+		}
+		if len(list.Repos) == limit {
+			list.Next = list.Repos[limit-1].Repo
+			break
+		}
+		list.Repos = append(list.Repos, rec)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handlerAPIRepo serves GET /api/repos/{repo} which returns
+// a single repo, e.g., /api/repos/github.company.com/Org/myrepo
+//
+// DELETE /api/repos/{repo} removes the repo, see
+// handlerAPIDelete.
+func handlerAPIRepo(w http.ResponseWriter, r *http.Request) {
+	repo := strings.Trim(strings.TrimPrefix(r.URL.Path, apiReposPath), "/")
+	if repo == "" {
+		handlerAPIRepos(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		handlerAPIDelete(w, r, repo)
+		return
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	rec, err := reg.GetRepo(repo)
+	if err == registry.ErrRepoNotRegistered {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("repo '%s' is not registered", repo))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error retrieving repo")
+		reqLog(w).Errorf("Error retrieving repo '%s': %s", repo, err.Error())
+		return
+	}
+	count, err := reg.GetTrigger()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error retrieving trigger value")
+		reqLog(w).Errorf("Error retrieving trigger value: %s", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, apiRepo{Record: rec, Trigger: count})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// newAPITestRegistry points reg at a new local registry
+// holding repos
+func newAPITestRegistry(t *testing.T, repos ...string) {
+	t.Helper()
+	conf = &config{DynamoDBtriggerKey: "00000trigger"}
+	reg = registry.NewBolt(filepath.Join(t.TempDir(), "registry.db"))
+	for _, repo := range repos {
+		if err := reg.PutRepo(registry.Record{Repo: repo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAPIListRepos(t *testing.T) {
+	newAPITestRegistry(t,
+		"github.company.com/Org/c",
+		"github.company.com/Org/a",
+		"github.company.com/Other/d",
+		"github.company.com/Org/b",
+	)
+	cases := []struct {
+		query     string
+		wantCode  int
+		wantRepos []string
+		wantNext  string
+	}{
+		{"", http.StatusOK, []string{"github.company.com/Org/a", "github.company.com/Org/b", "github.company.com/Org/c", "github.company.com/Other/d"}, ""},
+		{"?prefix=github.company.com/Org/", http.StatusOK, []string{"github.company.com/Org/a", "github.company.com/Org/b", "github.company.com/Org/c"}, ""},
+		{"?prefix=gitlab.company.com/", http.StatusOK, []string{}, ""},
+		{"?limit=2", http.StatusOK, []string{"github.company.com/Org/a", "github.company.com/Org/b"}, "github.company.com/Org/b"},
+		{"?limit=2&after=github.company.com/Org/b", http.StatusOK, []string{"github.company.com/Org/c", "github.company.com/Other/d"}, ""},
+		{"?limit=2&prefix=github.company.com/Org/&after=github.company.com/Org/b", http.StatusOK, []string{"github.company.com/Org/c"}, ""},
+		{"?limit=0", http.StatusBadRequest, nil, ""},
+		{"?limit=many", http.StatusBadRequest, nil, ""},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		handlerAPIRepos(w, httptest.NewRequest(http.MethodGet, apiReposPath+tc.query, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("%q: status = %d, want %d", tc.query, w.Code, tc.wantCode)
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		var list apiRepoList
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, rec := range list.Repos {
+			got = append(got, rec.Repo)
+		}
+		if len(got) != len(tc.wantRepos) || list.Next != tc.wantNext {
+			t.Errorf("%q: repos = %v next = %q, want %v and %q", tc.query, got, list.Next, tc.wantRepos, tc.wantNext)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.wantRepos[i] {
+				t.Errorf("%q: repos = %v, want %v", tc.query, got, tc.wantRepos)
+				break
+			}
+		}
+	}
+}
+
+func TestAPIGetRepo(t *testing.T) {
+	newAPITestRegistry(t, "github.company.com/Org/a")
+	cases := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, apiReposPath + "/github.company.com/Org/a", http.StatusOK},
+		{http.MethodGet, apiReposPath + "/github.company.com/Org/missing", http.StatusNotFound},
+		{http.MethodPut, apiReposPath + "/github.company.com/Org/a", http.StatusMethodNotAllowed},
+		{http.MethodPut, apiReposPath, http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		handlerAPIRepo(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.want {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.path, w.Code, tc.want)
+		}
+	}
+}
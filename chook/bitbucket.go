@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// bitbucketEventHeader holds the event key of hooks
+// sent by Bitbucket Server/Data Center
+const bitbucketEventHeader = "X-Event-Key"
+
+// bitbucketSignatureHeader holds the "sha256=<hex>"
+// HMAC-SHA256 signature of the raw request body
+const bitbucketSignatureHeader = "X-Hub-Signature"
+
+type bitbucketLink struct {
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+type bitbucketLinks struct {
+	Clone []bitbucketLink `json:"clone"`
+	Self  []bitbucketLink `json:"self"`
+}
+
+type bitbucketProject struct {
+	Key string `json:"key"`
+}
+
+type bitbucketRepository struct {
+	Slug    string           `json:"slug"`
+	Project bitbucketProject `json:"project"`
+	Links   bitbucketLinks   `json:"links"`
+}
+
+type bitbucketActor struct {
+	Name         string `json:"name"`
+	EmailAddress string `json:"emailAddress"`
+}
+
+type bitbucketRef struct {
+	Id        string `json:"id"`
+	DisplayId string `json:"displayId"`
+	Type      string `json:"type"`
+}
+
+type bitbucketChange struct {
+	Ref      bitbucketRef `json:"ref"`
+	FromHash string       `json:"fromHash"`
+	ToHash   string       `json:"toHash"`
+	Type     string       `json:"type"`
+}
+
+// bitbucketWebhook covers the fields we need from
+// Bitbucket Server's repo:refs_changed payload
+type bitbucketWebhook struct {
+	EventKey   string              `json:"eventKey"`
+	Actor      bitbucketActor      `json:"actor"`
+	Repository bitbucketRepository `json:"repository"`
+	Changes    []bitbucketChange   `json:"changes"`
+}
+
+// bitbucketProvider accepts hooks from Bitbucket
+// Server and Bitbucket Data Center
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) name() string {
+	return "bitbucket"
+}
+
+func (bitbucketProvider) detect(r *http.Request) bool {
+	return r.Header.Get(bitbucketEventHeader) != ""
+}
+
+func (bitbucketProvider) verify(r *http.Request, body []byte, repo string) error {
+	return conf.checkSignature(repo, body, r.Header.Get(bitbucketSignatureHeader))
+}
+
+func (bitbucketProvider) parse(r *http.Request, body []byte) (ev hookEvent, err error) {
+	var hook bitbucketWebhook
+	name := r.Header.Get(bitbucketEventHeader)
+	if name == "diagnostics:ping" {
+		// the "Test connection" button sends an empty body
+		ev.Name = name
+		ev.Kind = kindPing
+		ev.Ping = "test connection"
+		return ev, err
+	}
+	err = json.Unmarshal(body, &hook)
+	if err != nil {
+		return ev, err
+	}
+	ev = hook.event(name)
+	return ev, err
+}
+
+// cloneURL returns the http clone URL of the repo. Bitbucket
+// Server serves repos under /scm/ and needs the .git suffix
+// for go get to know it is a git repo, e.g.,
+// bitbucket.company.com/scm/proj/myrepo.git
+func (b *bitbucketRepository) cloneURL() string {
+	for _, l := range b.Links.Clone {
+		if l.Name == "http" || l.Name == "https" {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// event normalizes the Bitbucket Server payload using the
+// first branch or tag change in the hook
+func (b *bitbucketWebhook) event(name string) (ev hookEvent) {
+	ev.Name = name
+	ev.URL = b.Repository.cloneURL()
+	ev.Record.CloneURL = ev.URL
+	ev.Record.LastCommitUser = b.Actor.EmailAddress
+	if name != "repo:refs_changed" {
+		ev.ignore("Bitbucket event '%s' is not handled by chook, ignoring", name)
+		return ev
+	}
+	for _, c := range b.Changes {
+		if c.Type == "DELETE" {
+			continue
+		}
+		ev.Ref = c.Ref.Id
+		ev.Record.LastCommitId = c.ToHash
+		switch c.Ref.Type {
+		case "BRANCH":
+			ev.Kind = kindPush
+			return ev
+		case "TAG":
+			if c.Type == "ADD" {
+				ev.Kind = kindTag
+				ev.Tag = strings.TrimPrefix(c.Ref.Id, "refs/tags/")
+				return ev
+			}
+		}
+	}
+	ev.ignore("no branch or tag changes in Bitbucket event, ignoring")
+	return ev
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBitbucketEvent(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	const repo = `"repository":{"slug":"repo","project":{"key":"PROJ"},"links":{"clone":[{"href":"ssh://git@bitbucket.company.com:7999/proj/repo.git","name":"ssh"},{"href":"https://bitbucket.company.com/scm/proj/repo.git","name":"http"}]}}`
+	change := func(refType, refId, changeType string) string {
+		return `{"ref":{"id":"` + refId + `","type":"` + refType + `"},"toHash":"` + commit + `","type":"` + changeType + `"}`
+	}
+	cases := []struct {
+		name    string
+		event   string
+		body    string
+		want    string
+		wantRef string
+		wantTag string
+	}{
+		{"ping", "diagnostics:ping", "", kindPing, "", ""},
+		{"branch update", "repo:refs_changed", `{` + repo + `,"changes":[` + change("BRANCH", "refs/heads/main", "UPDATE") + `]}`, kindPush, "refs/heads/main", ""},
+		{"tag added", "repo:refs_changed", `{` + repo + `,"changes":[` + change("TAG", "refs/tags/v1.0.0", "ADD") + `]}`, kindTag, "refs/tags/v1.0.0", "v1.0.0"},
+		{"deletes are skipped", "repo:refs_changed", `{` + repo + `,"changes":[` + change("BRANCH", "refs/heads/old", "DELETE") + `,` + change("BRANCH", "refs/heads/main", "UPDATE") + `]}`, kindPush, "refs/heads/main", ""},
+		{"only a delete", "repo:refs_changed", `{` + repo + `,"changes":[` + change("BRANCH", "refs/heads/old", "DELETE") + `]}`, kindIgnore, "", ""},
+		{"pull request", "pr:opened", `{` + repo + `}`, kindIgnore, "", ""},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(tc.body))
+		r.Header.Set(bitbucketEventHeader, tc.event)
+		ev, err := bitbucketProvider{}.parse(r, []byte(tc.body))
+		if err != nil {
+			t.Errorf("%s: parse = %v", tc.name, err)
+			continue
+		}
+		if ev.Kind != tc.want || ev.Ref != tc.wantRef || ev.Tag != tc.wantTag {
+			t.Errorf("%s: kind = %q ref = %q tag = %q, want %q, %q and %q", tc.name, ev.Kind, ev.Ref, ev.Tag, tc.want, tc.wantRef, tc.wantTag)
+		}
+		if tc.want == kindPush && (ev.URL != "https://bitbucket.company.com/scm/proj/repo.git" || ev.Record.LastCommitId != commit) {
+			t.Errorf("%s: url = %q commit = %q, want the http clone URL and the new hash", tc.name, ev.URL, ev.Record.LastCommitId)
+		}
+	}
+	r := httptest.NewRequest(http.MethodPost, "/hook", nil)
+	r.Header.Set(bitbucketEventHeader, "repo:refs_changed")
+	if _, err := (bitbucketProvider{}).parse(r, []byte("not json")); err == nil {
+		t.Error("parse accepted a body that isn't JSON")
+	}
+}
+
+func TestGiteaEvent(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	body := `{"ref":"refs/heads/main","after":"` + commit + `","repository":{"html_url":"https://gitea.company.com/org/repo","clone_url":"https://gitea.company.com/org/repo.git","default_branch":"main"},"commits":[{"id":"` + commit + `"}]}`
+	cases := []struct {
+		name         string
+		headers      map[string]string
+		want         string
+		wantDelivery string
+	}{
+		{"gitea push", map[string]string{giteaEventHeader: "push", giteaDeliveryHeader: "gitea-1"}, kindPush, "gitea-1"},
+		{"forgejo push", map[string]string{forgejoEventHeader: "push", forgejoDeliveryHeader: "forgejo-1", giteaEventHeader: "push", giteaDeliveryHeader: "gitea-1"}, kindPush, "forgejo-1"},
+		{"gitea issue", map[string]string{giteaEventHeader: "issues"}, kindIgnore, ""},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if !(giteaProvider{}).detect(r) {
+			t.Errorf("%s: not detected as a Gitea hook", tc.name)
+		}
+		ev, err := giteaProvider{}.parse(r, []byte(body))
+		if err != nil {
+			t.Errorf("%s: parse = %v", tc.name, err)
+			continue
+		}
+		if ev.Kind != tc.want || ev.Delivery != tc.wantDelivery {
+			t.Errorf("%s: kind = %q delivery = %q, want %q and %q", tc.name, ev.Kind, ev.Delivery, tc.want, tc.wantDelivery)
+		}
+		if tc.want == kindPush && ev.Record.LastCommitId != commit {
+			t.Errorf("%s: commit = %q, want %q", tc.name, ev.Record.LastCommitId, commit)
+		}
+	}
+}
+
+func TestBitbucketGiteaVerify(t *testing.T) {
+	body := []byte(`{"changes":[]}`)
+	conf = newSecretsConfig(t, webhookSecret{Secret: "secret"})
+	const repo = "git.company.com/org/repo"
+	cases := []struct {
+		name   string
+		p      webhookProvider
+		header string
+		value  string
+		want   error
+	}{
+		{"bitbucket signed", bitbucketProvider{}, bitbucketSignatureHeader, "sha256=" + sign(body, "secret"), nil},
+		{"bitbucket wrong secret", bitbucketProvider{}, bitbucketSignatureHeader, "sha256=" + sign(body, "other"), errSignatureMismatch},
+		{"bitbucket unsigned", bitbucketProvider{}, "", "", errSignatureMissing},
+		{"gitea signed", giteaProvider{}, giteaSignatureHeader, sign(body, "secret"), nil},
+		{"forgejo signed", giteaProvider{}, forgejoSignatureHeader, sign(body, "secret"), nil},
+		{"gitea prefixed", giteaProvider{}, giteaSignatureHeader, "sha256=" + sign(body, "secret"), errSignatureMismatch},
+		{"gitea wrong secret", giteaProvider{}, giteaSignatureHeader, sign(body, "other"), errSignatureMismatch},
+		{"gitea unsigned", giteaProvider{}, "", "", errSignatureMissing},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/hook", nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		if got := tc.p.verify(r, body, repo); got != tc.want {
+			t.Errorf("%s: verify = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
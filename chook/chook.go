@@ -1,24 +1,25 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
+	"path"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
 )
 
 // conf holds config and exports for use in other
@@ -30,15 +31,49 @@ var conf *config
 // such as the DynamoDB table name and region
 type config struct {
 	ListenString       string `yaml:"listen_string"`
+	ReadTimeout        int    `yaml:"read_timeout"`
+	ReadHeaderTimeout  int    `yaml:"read_header_timeout"`
+	WriteTimeout       int    `yaml:"write_timeout"`
+	IdleTimeout        int    `yaml:"idle_timeout"`
+	ShutdownTimeout    int    `yaml:"shutdown_timeout"`
+	MaxBodyBytes       int64  `yaml:"max_body_bytes"`
+	DeliveryTTL        int    `yaml:"delivery_ttl"`
+	QueuePath          string `yaml:"queue_path"`
+	QueueWorkers       int    `yaml:"queue_workers"`
+	QueueMaxAttempts   int    `yaml:"queue_max_attempts"`
+	TLSCertFile        string `yaml:"tls_cert_file"`
+	TLSKeyFile         string `yaml:"tls_key_file"`
+	TLSClientCAFile    string `yaml:"tls_client_ca_file"`
+	LogLevel           string `yaml:"log_level"`
+	LogFormat          string `yaml:"log_format"`
+	Backend            string `yaml:"backend"`
+	LocalDBPath        string `yaml:"local_db_path"`
 	DynamoDBRegion     string `yaml:"dynamodb_region"`
 	DynamoDBTable      string `yaml:"dynamodb_table"`
 	DynamoDBtriggerKey string `yaml:"dynamodb_trigger_key"`
+
+	WebhookSecret              string          `yaml:"webhook_secret"`
+	WebhookSecretPrevious      string          `yaml:"webhook_secret_previous"`
+	WebhookSecretPreviousUntil string          `yaml:"webhook_secret_previous_until"`
+	WebhookSecrets             []webhookSecret `yaml:"webhook_secrets"`
+	Providers                  []string        `yaml:"providers"`
+	AdminTokens                []string        `yaml:"admin_tokens"`
+	AcceptedRefs               []string        `yaml:"accepted_refs"`
+	RepoAllow                  []string        `yaml:"repo_allow"`
+	RepoDeny                   []string        `yaml:"repo_deny"`
+
+	// webhookSecrets is the combined list of the default
+	// secret and any prefix scoped secrets
+	webhookSecrets []webhookSecret
+	// repoRules are the compiled repo_allow and
+	// repo_deny patterns
+	repoRules common.RepoRules
 }
 
 // loadConfigSecretsManager takes a secretname and loads it
 // from secrets manager
 func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error {
-	fmt.Println("attempting to load config from secrets manager")
+	log.Infof("attempting to load config from secrets manager")
 	//Create a Secrets Manager client
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		Config: aws.Config{Region: aws.String(secretRegion)},
@@ -54,7 +89,7 @@ func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error
 
 	result, err := svc.GetSecretValue(input)
 	if err != nil {
-		fmt.Printf("Error retrieving secret value. Error: '%s'\n", err.Error())
+		log.Errorf("Error retrieving secret value. Error: '%s'", err.Error())
 		return err
 	}
 
@@ -65,7 +100,7 @@ func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error
 		secretString = *result.SecretString
 		err = yaml.Unmarshal([]byte(secretString), c)
 		if err != nil {
-			fmt.Printf("Error unmarshaling secret text into Config object. Error: '%s'\n", err.Error())
+			log.Errorf("Error unmarshaling secret text into Config object. Error: '%s'", err.Error())
 			return err
 		}
 	}
@@ -78,26 +113,177 @@ func (c *config) loadConfigSecretsManager(secretName, secretRegion string) error
 // an error if something is wrong with a field.
 func (c *config) setConfigDefaults() (err error) {
 	// set defaults
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = common.LogFormatText
+	}
+	err = common.SetupLogging(c.LogLevel, c.LogFormat)
+	if err != nil {
+		return err
+	}
+	log.Infof("Starting with config '%s = %s'", "LogLevel", c.LogLevel)
+	log.Infof("Starting with config '%s = %s'", "LogFormat", c.LogFormat)
+
 	if c.ListenString == "" {
 		c.ListenString = ":5050"
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "ListenString", c.ListenString)
+	log.Infof("Starting with config '%s = %s'", "ListenString", c.ListenString)
+
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = 30
+	}
+	log.Infof("Starting with config '%s = %d'", "ReadTimeout", c.ReadTimeout)
+
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = 10
+	}
+	log.Infof("Starting with config '%s = %d'", "ReadHeaderTimeout", c.ReadHeaderTimeout)
+
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 30
+	}
+	log.Infof("Starting with config '%s = %d'", "WriteTimeout", c.WriteTimeout)
+
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = 120
+	}
+	log.Infof("Starting with config '%s = %d'", "IdleTimeout", c.IdleTimeout)
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30
+	}
+	log.Infof("Starting with config '%s = %d'", "ShutdownTimeout", c.ShutdownTimeout)
 
-	if c.DynamoDBRegion == "" {
-		c.DynamoDBRegion = "us-east-1"
+	if c.MaxBodyBytes == 0 {
+		// the most GitHub will send in a hook
+		c.MaxBodyBytes = 25 << 20
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "DynamoDBRegion", c.DynamoDBRegion)
+	log.Infof("Starting with config '%s = %d'", "MaxBodyBytes", c.MaxBodyBytes)
 
-	if c.DynamoDBTable == "" {
-		err = errors.New("missing configuration directive dynamodb_table")
+	if c.DeliveryTTL == 0 {
+		// GitHub lets deliveries from the last
+		// three days be redelivered
+		c.DeliveryTTL = 3 * 24 * 60 * 60
+	}
+	log.Infof("Starting with config '%s = %d'", "DeliveryTTL", c.DeliveryTTL)
+
+	if c.QueuePath != "" {
+		if c.QueueWorkers == 0 {
+			c.QueueWorkers = 4
+		}
+		if c.QueueMaxAttempts == 0 {
+			c.QueueMaxAttempts = 10
+		}
+		log.Infof("Starting with config '%s = %s'", "QueuePath", c.QueuePath)
+		log.Infof("Starting with config '%s = %d'", "QueueWorkers", c.QueueWorkers)
+		log.Infof("Starting with config '%s = %d'", "QueueMaxAttempts", c.QueueMaxAttempts)
+	}
+
+	if c.TLSCertFile != "" {
+		log.Infof("Starting with config '%s = %s'", "TLSCertFile", c.TLSCertFile)
+		log.Infof("Starting with config '%s = %s'", "TLSKeyFile", c.TLSKeyFile)
+	}
+	if c.TLSClientCAFile != "" {
+		log.Infof("Starting with config '%s = %s'", "TLSClientCAFile", c.TLSClientCAFile)
+	}
+
+	if c.Backend == "" {
+		c.Backend = registry.BackendDynamoDB
+	}
+	log.Infof("Starting with config '%s = %s'", "Backend", c.Backend)
+
+	switch c.Backend {
+	case registry.BackendDynamoDB:
+		if c.DynamoDBRegion == "" {
+			c.DynamoDBRegion = "us-east-1"
+		}
+		log.Infof("Starting with config '%s = %s'", "DynamoDBRegion", c.DynamoDBRegion)
+
+		if c.DynamoDBTable == "" {
+			err = errors.New("missing configuration directive dynamodb_table")
+			return err
+		}
+		log.Infof("Starting with config '%s = %s'", "DynamoDBTable", c.DynamoDBTable)
+	case registry.BackendLocal:
+		if c.LocalDBPath == "" {
+			c.LocalDBPath = "/var/lib/goarder/registry.db"
+		}
+		log.Infof("Starting with config '%s = %s'", "LocalDBPath", c.LocalDBPath)
+	default:
+		err = fmt.Errorf("unknown backend '%s', must be '%s' or '%s'", c.Backend, registry.BackendDynamoDB, registry.BackendLocal)
 		return err
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "DynamoDBTable", c.DynamoDBTable)
 
 	if c.DynamoDBtriggerKey == "" {
 		c.DynamoDBtriggerKey = "00000trigger"
 	}
-	fmt.Printf("Starting with config '%s = %s'\n", "DynamoDBtriggerKey", c.DynamoDBtriggerKey)
+	log.Infof("Starting with config '%s = %s'", "DynamoDBtriggerKey", c.DynamoDBtriggerKey)
+
+	if len(c.Providers) == 0 {
+		for _, p := range providers {
+			c.Providers = append(c.Providers, p.name())
+		}
+	}
+	for _, p := range c.Providers {
+		if providerByName(p) == nil {
+			err = fmt.Errorf("unknown webhook provider '%s' in providers", p)
+			return err
+		}
+	}
+	log.Infof("Starting with config '%s = %s'", "Providers", strings.Join(c.Providers, ","))
+
+	c.webhookSecrets = nil
+	if c.WebhookSecret != "" {
+		c.webhookSecrets = append(c.webhookSecrets, webhookSecret{
+			Secret:        c.WebhookSecret,
+			Previous:      c.WebhookSecretPrevious,
+			PreviousUntil: c.WebhookSecretPreviousUntil,
+		})
+	}
+	c.webhookSecrets = append(c.webhookSecrets, c.WebhookSecrets...)
+	for i := range c.webhookSecrets {
+		s := &c.webhookSecrets[i]
+		err = s.setDefaults()
+		if err != nil {
+			return err
+		}
+		common.RedactSecret(s.Secret)
+		common.RedactSecret(s.Previous)
+		log.Infof("Starting with config '%s = [redacted] (prefix '%s', rotating %t)'",
+			"WebhookSecret", s.Prefix, s.Previous != "")
+	}
+	if len(c.webhookSecrets) == 0 {
+		log.Warnf("no webhook_secret configured, webhook signatures will not be verified")
+	}
+
+	for _, t := range c.AdminTokens {
+		common.RedactSecret(t)
+	}
+	log.Infof("Starting with config '%s = [redacted] (%d tokens)'", "AdminTokens", len(c.AdminTokens))
+
+	err = checkRefPatterns(c.AcceptedRefs)
+	if err != nil {
+		return err
+	}
+	if len(c.AcceptedRefs) == 0 {
+		log.Infof("Starting with config '%s = %s'", "AcceptedRefs", refDefaultBranch)
+	} else {
+		log.Infof("Starting with config '%s = %s'", "AcceptedRefs", strings.Join(c.AcceptedRefs, ","))
+	}
+	for _, p := range c.Providers {
+		if p == (bitbucketProvider{}).name() && !hasExplicitRefs(c.AcceptedRefs) {
+			log.Warnf("bitbucket hooks don't send the default branch, their pushes are ignored until accepted_refs lists a branch, e.g., refs/heads/master")
+		}
+	}
+
+	c.repoRules, err = common.NewRepoRules(c.RepoAllow, c.RepoDeny)
+	if err != nil {
+		return err
+	}
+	log.Infof("Starting with config '%s = %s'", "RepoAllow", strings.Join(c.RepoAllow, ","))
+	log.Infof("Starting with config '%s = %s'", "RepoDeny", strings.Join(c.RepoDeny, ","))
 
 	return err
 }
@@ -130,177 +316,106 @@ type headCommit struct {
 }
 
 type repository struct {
-	SVNURL   string `json:"svn_url"`
-	SSHURL   string `json:"ssh_url"`
-	CloneURL string `json:"clone_url"`
-	GITURL   string `json:"git_url"`
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+	HTMLURL       string `json:"html_url"`
+	SVNURL        string `json:"svn_url"`
+	SSHURL        string `json:"ssh_url"`
+	CloneURL      string `json:"clone_url"`
+	GITURL        string `json:"git_url"`
 }
 
-type githubWebhook struct {
-	Ref        string     `json:"ref"`
-	Repository repository `json:"repository"`
-	HeadCommit headCommit `json:"head_commit"`
-	Repo       string
+type release struct {
+	TagName string `json:"tag_name"`
+	Name    string `json:"name"`
 }
 
-type trigger struct {
-	Repo  string `json:"repo"`
-	Count *int   `json:"count"`
-}
-
-func (t *trigger) dynamoFormat() map[string]*dynamodb.AttributeValue {
-	countString := strconv.Itoa(*t.Count)
-	rvalue := make(map[string]*dynamodb.AttributeValue)
-	rvalue["repo"] = &dynamodb.AttributeValue{
-		S: aws.String(t.Repo)}
-	rvalue["count"] = &dynamodb.AttributeValue{
-		N: &countString}
-	return rvalue
+type githubWebhook struct {
+	Ref        string       `json:"ref"`
+	RefType    string       `json:"ref_type"`
+	Action     string       `json:"action"`
+	Zen        string       `json:"zen"`
+	HookID     int          `json:"hook_id"`
+	Repository repository   `json:"repository"`
+	Release    release      `json:"release"`
+	After      string       `json:"after"`
+	HeadCommit headCommit   `json:"head_commit"`
+	Commits    []headCommit `json:"commits"`
 }
 
-func (t *trigger) getCounter() (err error) {
-	sess, err := session.NewSession(
-		&aws.Config{Region: aws.String(conf.DynamoDBRegion)},
-	)
-	if err != nil {
+// setRepo sets the go get repo name of g by parsing the URL
+func setRepo(g *registry.Record, rawURL string) (err error) {
+	log.Debugf("parsing repo name from URL '%s'", rawURL)
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		err = errors.New("error parsing URL to build go get repo name")
 		return err
 	}
-	dsvc := dynamodb.New(sess)
-	kvalue := make(map[string]*dynamodb.AttributeValue)
-	kvalue["repo"] = &dynamodb.AttributeValue{
-		S: aws.String(conf.DynamoDBtriggerKey)}
-	getItemInput := dynamodb.GetItemInput{
-		Key:       kvalue,
-		TableName: &conf.DynamoDBTable,
-	}
-	rvalue, err := dsvc.GetItem(&getItemInput)
-	if err != nil {
-		return err
+	// import paths have no user info or port so leave those
+	// out, the module path from go.mod is filled in by ahoy
+	g.Repo = u.Hostname() + strings.TrimSuffix(u.Path, "/")
+	return checkRepoName(g.Repo)
+}
+
+// checkRepoName returns an error if repo is not a name setRepo
+// could have derived, i.e., a host followed by a clean path
+// without a port, user info, query or fragment
+func checkRepoName(repo string) error {
+	if strings.ContainsAny(repo, ":@?#\\ \t\n") || path.Clean(repo) != repo ||
+		strings.HasPrefix(repo, "/") || !strings.Contains(repo, "/") {
+		return fmt.Errorf("invalid repo name '%s', must look like host/org/repo", repo)
 	}
-	if val, ok := rvalue.Item["count"]; ok {
-		cnt := 0
-		err = dynamodbattribute.Unmarshal(val, &cnt)
-		if err != nil {
-			return err
+	for _, elem := range strings.Split(repo, "/") {
+		if elem == "." || elem == ".." {
+			return fmt.Errorf("invalid repo name '%s', must look like host/org/repo", repo)
 		}
-		fmt.Printf("Detected count as %d\n", cnt)
-		tcount := cnt + 1
-		t.Count = &tcount
-		fmt.Printf("Updating new count: %d\n", *t.Count)
-		t.Repo = conf.DynamoDBtriggerKey
-		err = t.writeDynamo()
+	}
+	return nil
+}
+
+// checkRecord returns an error if the clone URL or commit
+// of g, which come straight from the hook or admin request,
+// aren't safe for ahoy to pass to git. The clone URL must be
+// an https or ssh URL on the repo's host and the commit a
+// full hex SHA.
+func checkRecord(g registry.Record) (err error) {
+	if g.LastCommitId != "" {
+		err = registry.CheckCommitId(g.LastCommitId)
 		if err != nil {
 			return err
 		}
 	}
-	return err
-}
-
-func (t *trigger) writeDynamo() (err error) {
-	fmt.Printf("In writedynamo i have cout of %d\n", *t.Count)
-	sess, err := session.NewSession(
-		&aws.Config{Region: aws.String(conf.DynamoDBRegion)},
-	)
-	if err != nil {
+	if g.CloneURL == "" {
 		return err
 	}
-	dsvc := dynamodb.New(sess)
-	ddbItem := t.dynamoFormat()
-	input := dynamodb.PutItemInput{
-		TableName: &conf.DynamoDBTable,
-		Item:      ddbItem,
-	}
-	fmt.Println("Attempting to write new trigger")
-	_, err = dsvc.PutItem(&input)
-	return err
-}
-
-// Sets the go get repo name by parsing the URL
-func (g *githubWebhook) setRepo() (err error) {
-	chunks := strings.Split(g.Repository.SVNURL, "//")
-	fmt.Println(g.Repository.SVNURL)
-	if len(chunks) > 1 {
-		g.Repo = chunks[1]
-	} else {
-		err = errors.New("error parsing URL to build go get repo name")
-	}
-	return err
-}
-
-func (g *githubWebhook) dynamoFormat() map[string]*dynamodb.AttributeValue {
-	rvalue := make(map[string]*dynamodb.AttributeValue)
-	rvalue["repo"] = &dynamodb.AttributeValue{
-		S: aws.String(g.Repo)}
-	rvalue["lastCommitId"] = &dynamodb.AttributeValue{
-		S: aws.String(g.HeadCommit.Id)}
-	rvalue["lastCommitMessage"] = &dynamodb.AttributeValue{
-		S: aws.String(g.HeadCommit.Message)}
-	rvalue["lastCommitUser"] = &dynamodb.AttributeValue{
-		S: aws.String(g.HeadCommit.Author.Email)}
-	return rvalue
-}
-
-func (g *githubWebhook) deleteDynamo() (err error) {
-	// first we need to do a getItem so we know the whole schema
-	// of the current key
-	sess, err := session.NewSession(
-		&aws.Config{Region: aws.String(conf.DynamoDBRegion)},
-	)
+	err = registry.CheckCloneURL(g.CloneURL)
 	if err != nil {
 		return err
 	}
-	dsvc := dynamodb.New(sess)
-	// prep for getitem of current hook key
-	kvalue := make(map[string]*dynamodb.AttributeValue)
-	kvalue["repo"] = &dynamodb.AttributeValue{
-		S: aws.String(g.Repo)}
-	getItemInput := dynamodb.GetItemInput{
-		Key:       kvalue,
-		TableName: &conf.DynamoDBTable,
-	}
-	_, err = dsvc.GetItem(&getItemInput)
+	cloneRepo, err := repoFromCloneURL(g.CloneURL)
 	if err != nil {
 		return err
 	}
-	// now that we have the exact object we can delete it
-	fmt.Printf("found repo '%s' in table, now deleting...\n", g.Repo)
-	dvalue := make(map[string]*dynamodb.AttributeValue)
-	dvalue["repo"] = &dynamodb.AttributeValue{
-		S: aws.String(g.Repo)}
-	input := dynamodb.DeleteItemInput{
-		TableName: &conf.DynamoDBTable,
-		Key:       dvalue,
+	host := strings.SplitN(g.Repo, "/", 2)[0]
+	if strings.SplitN(cloneRepo, "/", 2)[0] != host {
+		err = fmt.Errorf("clone URL '%s' is not on the repo's host '%s'", g.CloneURL, host)
 	}
-	_, err = dsvc.DeleteItem(&input)
 	return err
-
 }
 
-func (g *githubWebhook) writeDynamo(method string) (err error) {
+// writeRegistry creates or deletes the repo in the registry
+// depending on method
+func writeRegistry(g *registry.Record, method string) (err error) {
 	if g.Repo == conf.DynamoDBtriggerKey {
 		// protect the trigger key since users can control these writes
-		err = errors.New("cannot delete trigger key with hook methods")
+		err = errTriggerKeyProtected
 		return err
 	}
-	sess, err := session.NewSession(
-		&aws.Config{Region: aws.String(conf.DynamoDBRegion)},
-	)
-	if err != nil {
-		return err
-	}
-	dsvc := dynamodb.New(sess)
-	ddbItem := g.dynamoFormat()
-	if g.Repo == conf.DynamoDBtriggerKey {
-		err = errors.New("cannot delete trigger key with hook methods")
-	}
 	if method == "create" {
-		input := dynamodb.PutItemInput{
-			TableName: &conf.DynamoDBTable,
-			Item:      ddbItem,
-		}
-		_, err = dsvc.PutItem(&input)
+		err = reg.PutRepo(*g)
 	} else if method == "delete" {
-		err = g.deleteDynamo()
+		log.Infof("deleting repo '%s' from registry...", g.Repo)
+		err = reg.DeleteRepo(g.Repo)
 	} else {
 		err = errors.New(fmt.Sprintf("unknown method '%s'", method))
 	}
@@ -313,81 +428,121 @@ func healthcheck(w http.ResponseWriter, r *http.Request) {
 
 func handlerCreate(w http.ResponseWriter, r *http.Request) {
 	del := false
-	handlerCreateDelete(w, r, del)
+	handlerCreateDelete(w, r, del, nil)
 }
 
 func handlerDelete(w http.ResponseWriter, r *http.Request) {
 	del := true
-	handlerCreateDelete(w, r, del)
+	handlerCreateDelete(w, r, del, nil)
 }
 
-func handlerCreateDelete(w http.ResponseWriter, r *http.Request, del bool) {
+// handlerCreateDelete reads the hook and processes it with
+// provider p or the provider detected from its headers if
+// p is nil
+func handlerCreateDelete(w http.ResponseWriter, r *http.Request, del bool, p webhookProvider) {
 	switch r.Method {
 	case "POST":
-		buf := new(bytes.Buffer)
+		if r.ContentLength > conf.MaxBodyBytes {
+			writeHookError(w, http.StatusRequestEntityTooLarge, nil, "request body too large")
+			reqLog(w).Warnf("Rejecting hook of %d bytes, max_body_bytes is %d", r.ContentLength, conf.MaxBodyBytes)
+			return
+		}
 		bodyBytes, err := ioutil.ReadAll(r.Body)
-		buf.ReadFrom(r.Body)
-		newStr := buf.String()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			// chunked bodies have no length to check up front
+			writeHookError(w, http.StatusRequestEntityTooLarge, nil, "request body too large")
+			reqLog(w).Warnf("Rejecting hook larger than max_body_bytes (%d bytes)", tooLarge.Limit)
+			return
+		}
 		if err != nil {
-			http.Error(w, "could not read body", http.StatusInternalServerError)
+			writeHookError(w, http.StatusBadRequest, nil, "could not read body")
+			reqLog(w).Errorf("Error reading hook body: %s", err.Error())
 			return
 		}
-		fmt.Printf(newStr)
-		fmt.Println()
-		// try to parse webook to struct
-		var hook githubWebhook
-		json.Unmarshal(bodyBytes, &hook)
-		if len(hook.Repository.SVNURL) > 0 {
-			fmt.Println("parsed hook:")
-			fmt.Printf("\tRef: %s\n", hook.Ref)
-			fmt.Printf("\tAuthor: %s\n", hook.HeadCommit.Author.Name)
-			fmt.Printf("\tCommitId: %s\n", hook.HeadCommit.Id)
-			fmt.Printf("\tMessage: %s\n", hook.HeadCommit.Message)
-			err = hook.setRepo()
+		reqLog(w).With("body", string(bodyBytes)).Debugf("received hook")
+		handleHook(w, r, bodyBytes, del, p)
+	default:
+		w.Header().Set("Allow", http.MethodPost)
+		writeHookError(w, http.StatusMethodNotAllowed, nil, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// handlePush registers or removes the repo depending on
+// which route the hook came in on and bumps the trigger
+func handlePush(w http.ResponseWriter, ev *hookEvent, del bool) {
+	if len(ev.URL) > 0 {
+		err := setRepo(&ev.Record, ev.URL)
+		if err != nil {
+			writeHookError(w, http.StatusBadRequest, ev, "could not parse repo name")
+			reqLog(w).Errorf("Error parsing repo name: %s", err.Error())
+			return
+		}
+		reqLog(w).With("ref", ev.Ref).
+			With("author", ev.Record.LastCommitUser).
+			With("commit", ev.Record.LastCommitId).
+			With("message", ev.Record.LastCommitMessage).
+			With("repo", ev.Record.Repo).
+			Infof("parsed push")
+		action := actionCreated
+		if del {
+			action = actionDeleted
+			method := "delete"
+			err = writeRegistry(&ev.Record, method)
+			if err == errTriggerKeyProtected {
+				writeHookError(w, http.StatusBadRequest, ev, err.Error())
+				return
+			}
 			if err != nil {
-				http.Error(w, "could not parse repo name", http.StatusInternalServerError)
-				fmt.Printf("Error parsing repo name: %s\n", err.Error())
+				writeHookError(w, http.StatusInternalServerError, ev, "registry delete error")
+				reqLog(w).Errorf("registry delete error: %s", err.Error())
 				return
 			}
-			fmt.Printf("\tRepo: %s\n", hook.Repo)
-			if del {
-				method := "delete"
-				err = hook.writeDynamo(method)
-				if err != nil {
-					http.Error(w, "dynamo delete error", http.StatusInternalServerError)
-					fmt.Println(err.Error())
-					return
-				}
-				fmt.Printf("delete successful for repo '%s'\n", hook.Repo)
-			} else {
-				method := "create"
-				err = hook.writeDynamo(method)
-				if err != nil {
-					http.Error(w, "dynamo create error", http.StatusInternalServerError)
-					fmt.Println(err.Error())
-					return
-				}
-				fmt.Printf("create successful for repo '%s'\n", hook.Repo)
+			reqLog(w).Infof("delete successful for repo '%s'", ev.Record.Repo)
+		} else {
+			method := "create"
+			err = writeRegistry(&ev.Record, method)
+			if err == errTriggerKeyProtected {
+				writeHookError(w, http.StatusBadRequest, ev, err.Error())
+				return
 			}
-			// now update trigger
-			var t trigger
-			t.Count = &[]int{0}[0]
-			err = t.getCounter()
 			if err != nil {
-				http.Error(w, "error retreiving trigger value", http.StatusInternalServerError)
-				fmt.Println(err.Error())
+				writeHookError(w, http.StatusInternalServerError, ev, "registry create error")
+				reqLog(w).Errorf("registry create error: %s", err.Error())
 				return
 			}
-		} else {
-			fmt.Println("failure to parse hook")
-			fmt.Println(hook)
+			reqLog(w).Infof("create successful for repo '%s'", ev.Record.Repo)
+		}
+		// now update trigger
+		count, ok := updateTrigger(w, ev)
+		if ok {
+			writeHook(w, http.StatusOK, ev, hookResponse{Action: action, Trigger: count})
 		}
-		fmt.Println()
+	} else {
+		writeHookError(w, http.StatusBadRequest, ev, "payload has no repository")
+		reqLog(w).With("event", fmt.Sprintf("%+v", *ev)).Errorf("failure to parse hook")
+	}
+}
+
+// updateTrigger bumps the trigger count so that ahoy
+// knows to rescan the registry. If that fails the error
+// response for ev is written to w.
+func updateTrigger(w http.ResponseWriter, ev *hookEvent) (count int, ok bool) {
+	count, err := reg.BumpTrigger()
+	if err != nil {
+		writeHookError(w, http.StatusInternalServerError, ev, "error updating trigger value")
+		reqLog(w).Errorf("error updating trigger value: %s", err.Error())
+		return count, false
 	}
+	reqLog(w).Infof("Updated trigger count to %d", count)
+	return count, true
 }
 
 var version string
 
+// log is the logger every request logger is derived from
+var log = common.Log
+
 func main() {
 	c := config{}
 	conf = &c
@@ -408,19 +563,63 @@ func main() {
 	// if that fails load from secrets manager
 	err := c.loadConfigFile(configFile)
 	if err != nil {
-		fmt.Printf("Unable to load config from file. Error: '%s'\n", err.Error())
+		log.Errorf("Unable to load config from file. Error: '%s'", err.Error())
 		err := c.loadConfigSecretsManager(secretName, secretRegion)
 		if err != nil {
-			fmt.Printf("Unable to load config from secrets manager. Error: '%s'\n", err.Error())
+			log.Errorf("Unable to load config from secrets manager. Error: '%s'", err.Error())
 			os.Exit(1)
 		}
 	}
 
+	reg, err = newRegistry(conf)
+	if err != nil {
+		log.Errorf("Unable to set up %s registry. Error: '%s'", conf.Backend, err.Error())
+		os.Exit(1)
+	}
+	reg = newInstrumentedRegistry(conf.Backend, reg)
+	// read the trigger once so its metric has a value
+	// before the first hook arrives
+	_, err = reg.GetTrigger()
+	if err != nil {
+		log.Warnf("Unable to read trigger value: %s", err.Error())
+	}
+
+	if conf.QueuePath != "" {
+		queue, err = openHookQueue(conf.QueuePath, conf.QueueMaxAttempts)
+		if err != nil {
+			log.Errorf("Unable to open hook queue '%s'. Error: '%s'", conf.QueuePath, err.Error())
+			os.Exit(1)
+		}
+		queue.start(conf.QueueWorkers)
+	}
+
 	// handle route using handler function
 	http.HandleFunc("/hook", handlerCreate)
 	http.HandleFunc("/delete", handlerDelete)
+	http.HandleFunc("/hook/", handlerProviderRoute)
+	http.HandleFunc("/delete/", handlerProviderRoute)
+	http.HandleFunc(apiReposPath, handlerAPIRepos)
+	http.HandleFunc(apiReposPath+"/", handlerAPIRepo)
+	http.HandleFunc(apiResyncPath, handlerAPIResync)
+	http.HandleFunc(apiQueuePath, handlerAPIQueue)
+	http.HandleFunc(common.MetricsPath, common.HandlerMetrics)
 	http.HandleFunc("/", healthcheck)
 
 	// listen to port
-	http.ListenAndServe(conf.ListenString, nil)
+	srv := newServer(conf, withRequestLog(http.DefaultServeMux))
+	srv.TLSConfig, err = newTLSConfig(conf)
+	if err != nil {
+		log.Errorf("Unable to set up TLS. Error: '%s'", err.Error())
+		os.Exit(1)
+	}
+	err = serve(srv, time.Duration(conf.ShutdownTimeout)*time.Second)
+	if queue != nil {
+		// hooks that are still queued are applied
+		// when chook starts again
+		queue.close(time.Duration(conf.ShutdownTimeout) * time.Second)
+	}
+	if err != nil {
+		log.Errorf("Unable to serve on '%s'. Error: '%s'", conf.ListenString, err.Error())
+		os.Exit(1)
+	}
 }
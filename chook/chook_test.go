@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+func TestCheckRecord(t *testing.T) {
+	const repo = "github.company.com/Org/repo"
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	cases := []struct {
+		name string
+		rec  registry.Record
+		ok   bool
+	}{
+		{"https", registry.Record{Repo: repo, CloneURL: "https://github.company.com/Org/repo.git", LastCommitId: sha}, true},
+		{"scp style ssh", registry.Record{Repo: repo, CloneURL: "git@github.company.com:Org/repo.git", LastCommitId: sha}, true},
+		{"no clone URL or commit", registry.Record{Repo: repo}, true},
+		{"option as commit", registry.Record{Repo: repo, LastCommitId: "--upload-pack=touch /tmp/pwned"}, false},
+		{"short commit", registry.Record{Repo: repo, LastCommitId: "0123456"}, false},
+		{"option as clone URL", registry.Record{Repo: repo, CloneURL: "--upload-pack=touch /tmp/pwned"}, false},
+		{"file clone URL", registry.Record{Repo: repo, CloneURL: "file:///etc"}, false},
+		{"ext clone URL", registry.Record{Repo: repo, CloneURL: "ext::sh -c touch% /tmp/pwned"}, false},
+		{"other host", registry.Record{Repo: repo, CloneURL: "https://evil.example.com/Org/repo.git"}, false},
+	}
+	for _, tc := range cases {
+		err := checkRecord(tc.rec)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: checkRecord = %v, want ok %t", tc.name, err, tc.ok)
+		}
+	}
+}
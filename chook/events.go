@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// event kinds tell chook what to do with a hook
+// regardless of which provider sent it
+const (
+	kindPing    = "ping"
+	kindPush    = "push"
+	kindRemove  = "remove"
+	kindTag     = "tag"
+	kindRelease = "release"
+	kindIgnore  = "ignore"
+)
+
+// hookEvent is the normalized form of a webhook
+// that every provider parses its payload into
+type hookEvent struct {
+	// Provider is the name of the provider that sent the hook
+	Provider string
+	// Name is the event type as sent by the provider
+	Name string
+	// Kind is one of the kind constants
+	Kind string
+	// Action is the provider's action for the event if any
+	Action string
+	// Reason explains why an event of kindIgnore is ignored
+	Reason string
+	// Ref is the ref that was pushed
+	Ref string
+	// DefaultBranch is the repo's default branch if the
+	// provider sends it
+	DefaultBranch string
+	// Tag is the tag or release name for tag and release events
+	Tag string
+	// Ping describes the hook for ping events
+	Ping string
+	// Delivery is the provider's ID for this delivery of the
+	// hook which stays the same when it is redelivered
+	Delivery string
+	// URL is the web URL of the repo and is used to
+	// derive Record.Repo
+	URL string
+	// Record holds the repo as it will be stored
+	Record registry.Record
+}
+
+// ignore marks the event as one chook does not act on
+func (ev *hookEvent) ignore(format string, a ...interface{}) {
+	ev.Kind = kindIgnore
+	ev.Reason = fmt.Sprintf(format, a...)
+}
+
+// eventHandler processes a single kind of event. del is true
+// when the hook was received on a /delete route.
+type eventHandler func(w http.ResponseWriter, ev *hookEvent, del bool)
+
+// eventHandlers maps each event kind to its handler.
+// Events of any other kind are answered with a 202.
+var eventHandlers = map[string]eventHandler{
+	kindPing:    handlePing,
+	kindPush:    handlePush,
+	kindRemove:  handleRemove,
+	kindTag:     handleTag,
+	kindRelease: handleRelease,
+}
+
+// configSummary is the non sensitive subset of the
+// config that is returned when a provider pings us
+type configSummary struct {
+	ListenString       string   `json:"listenString"`
+	Backend            string   `json:"backend"`
+	DynamoDBRegion     string   `json:"dynamodbRegion"`
+	DynamoDBTable      string   `json:"dynamodbTable"`
+	DynamoDBtriggerKey string   `json:"dynamodbTriggerKey"`
+	Providers          []string `json:"providers"`
+	AcceptedRefs       []string `json:"acceptedRefs"`
+	SignaturesVerified bool     `json:"signaturesVerified"`
+	SecretPrefixes     []string `json:"secretPrefixes"`
+}
+
+func (c *config) summary() (s configSummary) {
+	s.ListenString = c.ListenString
+	s.Backend = c.Backend
+	s.DynamoDBRegion = c.DynamoDBRegion
+	s.DynamoDBTable = c.DynamoDBTable
+	s.DynamoDBtriggerKey = c.DynamoDBtriggerKey
+	s.Providers = c.Providers
+	s.AcceptedRefs = c.AcceptedRefs
+	if len(s.AcceptedRefs) == 0 {
+		s.AcceptedRefs = []string{refDefaultBranch}
+	}
+	s.SignaturesVerified = len(c.webhookSecrets) > 0
+	s.SecretPrefixes = []string{}
+	for _, secret := range c.webhookSecrets {
+		s.SecretPrefixes = append(s.SecretPrefixes, secret.Prefix)
+	}
+	return s
+}
+
+// handlePing answers the ping sent when a hook is
+// first created with a pong and our config summary
+func handlePing(w http.ResponseWriter, ev *hookEvent, del bool) {
+	reqLog(w).Infof("received %s ping: %s", ev.Provider, ev.Ping)
+	pong := struct {
+		hookResponse
+		Msg    string        `json:"msg"`
+		Config configSummary `json:"config"`
+	}{
+		hookResponse: hookResponse{
+			Provider: ev.Provider,
+			Event:    ev.Name,
+			Action:   actionPong,
+		},
+		Msg:    "pong",
+		Config: conf.summary(),
+	}
+	writeJSON(w, http.StatusOK, pong)
+}
+
+// handleRemove removes the repo from the table when
+// it is deleted or archived on the server
+func handleRemove(w http.ResponseWriter, ev *hookEvent, del bool) {
+	err := setRepo(&ev.Record, ev.URL)
+	if err != nil {
+		writeHookError(w, http.StatusBadRequest, ev, "could not parse repo name")
+		reqLog(w).Errorf("Error parsing repo name: %s", err.Error())
+		return
+	}
+	reqLog(w).Infof("repo '%s' was %s, removing", ev.Record.Repo, ev.Action)
+	err = writeRegistry(&ev.Record, "delete")
+	if err == errTriggerKeyProtected {
+		writeHookError(w, http.StatusBadRequest, ev, err.Error())
+		return
+	}
+	if err != nil {
+		writeHookError(w, http.StatusInternalServerError, ev, "registry delete error")
+		reqLog(w).Errorf("registry delete error: %s", err.Error())
+		return
+	}
+	reqLog(w).Infof("delete successful for repo '%s'", ev.Record.Repo)
+	count, ok := updateTrigger(w, ev)
+	if ok {
+		writeHook(w, http.StatusOK, ev, hookResponse{
+			Action:  actionDeleted,
+			Reason:  fmt.Sprintf("repo was %s", ev.Action),
+			Trigger: count,
+		})
+	}
+}
+
+// handleTag records newly created tags against the repo
+func handleTag(w http.ResponseWriter, ev *hookEvent, del bool) {
+	recordEvent(w, ev, "lastTag", ev.Tag)
+}
+
+// handleRelease records the tag of a published
+// release against the repo
+func handleRelease(w http.ResponseWriter, ev *hookEvent, del bool) {
+	recordEvent(w, ev, "lastRelease", ev.Tag)
+}
+
+// recordEvent stores value in attribute on an already
+// registered repo and writes the outcome to w
+func recordEvent(w http.ResponseWriter, ev *hookEvent, attribute, value string) {
+	err := setRepo(&ev.Record, ev.URL)
+	if err != nil {
+		writeHookError(w, http.StatusBadRequest, ev, "could not parse repo name")
+		reqLog(w).Errorf("Error parsing repo name: %s", err.Error())
+		return
+	}
+	err = recordRegistry(&ev.Record, attribute, value)
+	if err == registry.ErrRepoNotRegistered {
+		writeHook(w, http.StatusAccepted, ev, hookResponse{
+			Action: actionIgnored,
+			Reason: "repo is not registered",
+		})
+		return
+	}
+	if err == errTriggerKeyProtected {
+		writeHookError(w, http.StatusBadRequest, ev, err.Error())
+		return
+	}
+	if err != nil {
+		writeHookError(w, http.StatusInternalServerError, ev, "registry update error")
+		reqLog(w).Errorf("registry update error: %s", err.Error())
+		return
+	}
+	reqLog(w).Infof("recorded %s = '%s' for repo '%s'", attribute, value, ev.Record.Repo)
+	if ev.Delivery != "" {
+		err = recordRegistry(&ev.Record, "lastDelivery", ev.Delivery)
+		if err != nil {
+			reqLog(w).Warnf("could not record delivery for repo '%s': %s", ev.Record.Repo, err.Error())
+		}
+	}
+	// recording a tag or release doesn't change what ahoy
+	// fetches so the trigger is left alone
+	writeHook(w, http.StatusOK, ev, hookResponse{
+		Action: actionRecorded,
+		Reason: fmt.Sprintf("%s = '%s'", attribute, value),
+	})
+}
+
+// recordRegistry sets a single attribute on the repo
+// without registering the repo if it does not exist yet
+func recordRegistry(g *registry.Record, attribute, value string) (err error) {
+	if g.Repo == conf.DynamoDBtriggerKey {
+		// protect the trigger key since users can control these writes
+		err = errTriggerKeyProtected
+		return err
+	}
+	return reg.SetRepoAttribute(g.Repo, attribute, value)
+}
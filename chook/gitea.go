@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Gitea and its fork Forgejo send the same payloads but
+// each under their own headers. Forgejo sends both sets.
+const (
+	giteaEventHeader       = "X-Gitea-Event"
+	giteaSignatureHeader   = "X-Gitea-Signature"
+	giteaDeliveryHeader    = "X-Gitea-Delivery"
+	forgejoEventHeader     = "X-Forgejo-Event"
+	forgejoSignatureHeader = "X-Forgejo-Signature"
+	forgejoDeliveryHeader  = "X-Forgejo-Delivery"
+)
+
+// giteaProvider accepts hooks from Gitea and Forgejo.
+// Their payloads follow GitHub's so githubWebhook is
+// used to parse them.
+type giteaProvider struct{}
+
+func (giteaProvider) name() string {
+	return "gitea"
+}
+
+func (giteaProvider) detect(r *http.Request) bool {
+	return r.Header.Get(giteaEventHeader) != "" || r.Header.Get(forgejoEventHeader) != ""
+}
+
+func (giteaProvider) verify(r *http.Request, body []byte, repo string) error {
+	sig := r.Header.Get(forgejoSignatureHeader)
+	if sig == "" {
+		sig = r.Header.Get(giteaSignatureHeader)
+	}
+	return conf.checkHexSignature(repo, body, sig)
+}
+
+func (giteaProvider) parse(r *http.Request, body []byte) (ev hookEvent, err error) {
+	var hook githubWebhook
+	err = json.Unmarshal(body, &hook)
+	if err != nil {
+		return ev, err
+	}
+	name := r.Header.Get(forgejoEventHeader)
+	if name == "" {
+		name = r.Header.Get(giteaEventHeader)
+	}
+	ev = hook.event(name)
+	ev.Delivery = r.Header.Get(forgejoDeliveryHeader)
+	if ev.Delivery == "" {
+		ev.Delivery = r.Header.Get(giteaDeliveryHeader)
+	}
+	return ev, err
+}
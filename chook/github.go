@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// githubEventHeader tells us which type of
+// event the hook payload describes
+const githubEventHeader = "X-GitHub-Event"
+
+// githubDeliveryHeader holds the GUID of the delivery
+// which is kept when it is redelivered
+const githubDeliveryHeader = "X-GitHub-Delivery"
+
+// githubSignatureHeader holds the HMAC-SHA256
+// signature of the raw request body
+const githubSignatureHeader = "X-Hub-Signature-256"
+
+// githubProvider accepts hooks from GitHub and
+// GitHub Enterprise servers
+type githubProvider struct{}
+
+func (githubProvider) name() string {
+	return "github"
+}
+
+func (githubProvider) detect(r *http.Request) bool {
+	return r.Header.Get(githubEventHeader) != ""
+}
+
+func (githubProvider) verify(r *http.Request, body []byte, repo string) error {
+	return conf.checkSignature(repo, body, r.Header.Get(githubSignatureHeader))
+}
+
+func (githubProvider) parse(r *http.Request, body []byte) (ev hookEvent, err error) {
+	var hook githubWebhook
+	err = json.Unmarshal(body, &hook)
+	if err != nil {
+		return ev, err
+	}
+	name := r.Header.Get(githubEventHeader)
+	if name == "" {
+		// hooks sent without an event header are
+		// assumed to be pushes like they always were
+		name = "push"
+	}
+	ev = hook.event(name)
+	ev.Delivery = r.Header.Get(githubDeliveryHeader)
+	return ev, err
+}
+
+// event normalizes the payload of the GitHub event called
+// name. Gitea's payloads follow the same shape so it is
+// used for those as well.
+func (g *githubWebhook) event(name string) (ev hookEvent) {
+	ev.Name = name
+	ev.Action = g.Action
+	ev.Ref = g.Ref
+	ev.DefaultBranch = g.Repository.DefaultBranch
+	ev.Record.CloneURL = g.Repository.CloneURL
+	ev.URL = g.Repository.SVNURL
+	if ev.URL == "" {
+		ev.URL = g.Repository.HTMLURL
+	}
+	commit := g.HeadCommit
+	if commit.Id == "" {
+		// not every server sends head_commit so fall
+		// back to the commit the ref now points to
+		for _, c := range g.Commits {
+			if c.Id == g.After {
+				commit = c
+			}
+		}
+	}
+	ev.Record.LastCommitId = commit.Id
+	ev.Record.LastCommitMessage = commit.Message
+	ev.Record.LastCommitUser = commit.Author.Email
+	switch name {
+	case "ping":
+		ev.Kind = kindPing
+		ev.Ping = fmt.Sprintf("hook %d: %s", g.HookID, g.Zen)
+	case "push":
+		ev.Kind = kindPush
+	case "repository":
+		if g.Action == "deleted" || g.Action == "archived" {
+			ev.Kind = kindRemove
+		} else {
+			ev.ignore("repository action '%s' requires no changes, ignoring", g.Action)
+		}
+	case "release":
+		if g.Action == "published" {
+			ev.Kind = kindRelease
+			ev.Tag = g.Release.TagName
+		} else {
+			ev.ignore("release action '%s' requires no changes, ignoring", g.Action)
+		}
+	case "create":
+		if g.RefType == "tag" {
+			ev.Kind = kindTag
+			ev.Tag = g.Ref
+		} else {
+			ev.ignore("created ref type '%s' requires no changes, ignoring", g.RefType)
+		}
+	default:
+		ev.ignore("event '%s' is not handled by chook, ignoring", name)
+	}
+	return ev
+}
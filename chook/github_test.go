@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGitHubEvent(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	cases := []struct {
+		name    string
+		event   string
+		body    string
+		want    string
+		wantTag string
+	}{
+		{"push", "push", `{"ref":"refs/heads/main","head_commit":{"id":"` + commit + `"}}`, kindPush, ""},
+		{"no event header", "", `{"ref":"refs/heads/main"}`, kindPush, ""},
+		{"ping", "ping", `{"hook_id":1,"zen":"Keep it logically awesome."}`, kindPing, ""},
+		{"repository deleted", "repository", `{"action":"deleted"}`, kindRemove, ""},
+		{"repository archived", "repository", `{"action":"archived"}`, kindRemove, ""},
+		{"repository renamed", "repository", `{"action":"renamed"}`, kindIgnore, ""},
+		{"release published", "release", `{"action":"published","release":{"tag_name":"v1.2.0"}}`, kindRelease, "v1.2.0"},
+		{"release drafted", "release", `{"action":"created","release":{"tag_name":"v1.2.0"}}`, kindIgnore, ""},
+		{"tag created", "create", `{"ref":"v1.2.0","ref_type":"tag"}`, kindTag, "v1.2.0"},
+		{"branch created", "create", `{"ref":"feature","ref_type":"branch"}`, kindIgnore, ""},
+		{"unhandled event", "issues", `{"action":"opened"}`, kindIgnore, ""},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(tc.body))
+		if tc.event != "" {
+			r.Header.Set(githubEventHeader, tc.event)
+		}
+		r.Header.Set(githubDeliveryHeader, "guid-1")
+		ev, err := githubProvider{}.parse(r, []byte(tc.body))
+		if err != nil {
+			t.Errorf("%s: parse = %v", tc.name, err)
+			continue
+		}
+		if ev.Kind != tc.want || ev.Tag != tc.wantTag {
+			t.Errorf("%s: kind = %q tag = %q, want %q and %q", tc.name, ev.Kind, ev.Tag, tc.want, tc.wantTag)
+		}
+		if ev.Kind == kindIgnore && ev.Reason == "" {
+			t.Errorf("%s: ignored without a reason", tc.name)
+		}
+		if ev.Delivery != "guid-1" {
+			t.Errorf("%s: delivery = %q", tc.name, ev.Delivery)
+		}
+	}
+	if _, err := (githubProvider{}).parse(httptest.NewRequest(http.MethodPost, "/hook", nil), []byte("not json")); err == nil {
+		t.Error("parse accepted a body that isn't JSON")
+	}
+}
+
+func TestGitHubPushCommit(t *testing.T) {
+	const head = "0123456789abcdef0123456789abcdef01234567"
+	const after = "89abcdef0123456789abcdef0123456789abcdef"
+	cases := []struct {
+		name string
+		hook githubWebhook
+		want string
+	}{
+		{"head commit", githubWebhook{HeadCommit: headCommit{Id: head}, After: after}, head},
+		{"commit after the push", githubWebhook{After: after, Commits: []headCommit{{Id: head}, {Id: after}}}, after},
+		{"no commits", githubWebhook{After: after}, ""},
+	}
+	for _, tc := range cases {
+		if got := tc.hook.event("push").Record.LastCommitId; got != tc.want {
+			t.Errorf("%s: commit = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// gitlabEventHeader is set by GitLab on every webhook and
+// is how we tell GitLab hooks apart from GitHub hooks
+const gitlabEventHeader = "X-Gitlab-Event"
+
+// gitlabTokenHeader carries the secret configured on
+// the GitLab hook in plain text
+const gitlabTokenHeader = "X-Gitlab-Token"
+
+// gitlabInstanceHeader holds the base URL of the GitLab
+// instance that sent the hook
+const gitlabInstanceHeader = "X-Gitlab-Instance"
+
+type gitlabAuthor struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type gitlabCommit struct {
+	Id      string       `json:"id"`
+	Message string       `json:"message"`
+	Author  gitlabAuthor `json:"author"`
+}
+
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+	GitHTTPURL        string `json:"git_http_url"`
+	GitSSHURL         string `json:"git_ssh_url"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+// gitlabWebhook covers the fields we need from GitLab push,
+// tag push and system hook (project event) payloads
+type gitlabWebhook struct {
+	ObjectKind        string         `json:"object_kind"`
+	EventName         string         `json:"event_name"`
+	Ref               string         `json:"ref"`
+	CheckoutSHA       string         `json:"checkout_sha"`
+	UserEmail         string         `json:"user_email"`
+	Project           gitlabProject  `json:"project"`
+	Commits           []gitlabCommit `json:"commits"`
+	PathWithNamespace string         `json:"path_with_namespace"`
+}
+
+// gitlabProvider accepts project hooks and system
+// hooks from a self-managed GitLab
+type gitlabProvider struct{}
+
+func (gitlabProvider) name() string {
+	return "gitlab"
+}
+
+func (gitlabProvider) detect(r *http.Request) bool {
+	return r.Header.Get(gitlabEventHeader) != ""
+}
+
+func (gitlabProvider) verify(r *http.Request, body []byte, repo string) error {
+	return conf.checkToken(repo, r.Header.Get(gitlabTokenHeader))
+}
+
+func (gitlabProvider) parse(r *http.Request, body []byte) (ev hookEvent, err error) {
+	var hook gitlabWebhook
+	err = json.Unmarshal(body, &hook)
+	if err != nil {
+		return ev, err
+	}
+	ev = hook.event(r.Header.Get(gitlabInstanceHeader))
+	return ev, err
+}
+
+// event normalizes the GitLab payload. instance is the value
+// of the X-Gitlab-Instance header and is only needed for
+// system hooks which carry no project URL.
+func (g *gitlabWebhook) event(instance string) (ev hookEvent) {
+	ev.Name = g.kind()
+	ev.Ref = g.Ref
+	ev.DefaultBranch = g.Project.DefaultBranch
+	ev.Record.CloneURL = g.Project.GitHTTPURL
+	ev.URL = g.Project.WebURL
+	if ev.URL == "" && g.PathWithNamespace != "" && instance != "" {
+		ev.URL = strings.TrimSuffix(instance, "/") + "/" + g.PathWithNamespace
+	}
+	ev.Record.LastCommitId = g.CheckoutSHA
+	ev.Record.LastCommitUser = g.UserEmail
+	// prefer the details of the commit the ref now points to
+	for _, c := range g.Commits {
+		if c.Id == g.CheckoutSHA {
+			ev.Record.LastCommitMessage = c.Message
+			ev.Record.LastCommitUser = c.Author.Email
+		}
+	}
+	switch ev.Name {
+	case "push":
+		ev.Kind = kindPush
+	case "tag_push":
+		if g.CheckoutSHA == "" {
+			// tag deletions have no checkout sha
+			ev.ignore("deleted tag '%s' requires no changes, ignoring", g.Ref)
+		} else {
+			ev.Kind = kindTag
+			ev.Tag = strings.TrimPrefix(g.Ref, "refs/tags/")
+		}
+	case "project_destroy":
+		ev.Kind = kindRemove
+		ev.Action = "deleted"
+	default:
+		ev.ignore("GitLab event '%s' is not handled by chook, ignoring", ev.Name)
+	}
+	return ev
+}
+
+// kind returns the type of event regardless of whether
+// it came from a project hook or a system hook
+func (g *gitlabWebhook) kind() string {
+	if g.ObjectKind != "" {
+		return g.ObjectKind
+	}
+	return g.EventName
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGitLabEvent(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	const project = `"project":{"web_url":"https://gitlab.company.com/group/repo","git_http_url":"https://gitlab.company.com/group/repo.git","default_branch":"main"}`
+	cases := []struct {
+		name     string
+		instance string
+		body     string
+		want     string
+		wantTag  string
+		wantURL  string
+	}{
+		{"push", "", `{"object_kind":"push","ref":"refs/heads/main","checkout_sha":"` + commit + `",` + project + `}`, kindPush, "", "https://gitlab.company.com/group/repo"},
+		{"tag push", "", `{"object_kind":"tag_push","ref":"refs/tags/v1.0.0","checkout_sha":"` + commit + `",` + project + `}`, kindTag, "v1.0.0", "https://gitlab.company.com/group/repo"},
+		{"tag deleted", "", `{"object_kind":"tag_push","ref":"refs/tags/v1.0.0",` + project + `}`, kindIgnore, "", "https://gitlab.company.com/group/repo"},
+		{"system hook project destroyed", "https://gitlab.company.com/", `{"event_name":"project_destroy","path_with_namespace":"group/repo"}`, kindRemove, "", "https://gitlab.company.com/group/repo"},
+		{"merge request", "", `{"object_kind":"merge_request",` + project + `}`, kindIgnore, "", "https://gitlab.company.com/group/repo"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(tc.body))
+		r.Header.Set(gitlabEventHeader, "Push Hook")
+		if tc.instance != "" {
+			r.Header.Set(gitlabInstanceHeader, tc.instance)
+		}
+		ev, err := gitlabProvider{}.parse(r, []byte(tc.body))
+		if err != nil {
+			t.Errorf("%s: parse = %v", tc.name, err)
+			continue
+		}
+		if ev.Kind != tc.want || ev.Tag != tc.wantTag || ev.URL != tc.wantURL {
+			t.Errorf("%s: kind = %q tag = %q url = %q, want %q, %q and %q", tc.name, ev.Kind, ev.Tag, ev.URL, tc.want, tc.wantTag, tc.wantURL)
+		}
+	}
+	if _, err := (gitlabProvider{}).parse(httptest.NewRequest(http.MethodPost, "/hook", nil), []byte("not json")); err == nil {
+		t.Error("parse accepted a body that isn't JSON")
+	}
+}
+
+func TestGitLabPushCommit(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	hook := gitlabWebhook{
+		ObjectKind:  "push",
+		CheckoutSHA: commit,
+		UserEmail:   "pusher@company.com",
+		Commits: []gitlabCommit{
+			{Id: "89abcdef0123456789abcdef0123456789abcdef", Message: "older", Author: gitlabAuthor{Email: "old@company.com"}},
+			{Id: commit, Message: "newest", Author: gitlabAuthor{Email: "author@company.com"}},
+		},
+	}
+	rec := hook.event("").Record
+	if rec.LastCommitId != commit || rec.LastCommitMessage != "newest" || rec.LastCommitUser != "author@company.com" {
+		t.Errorf("record = %+v, want the details of the checked out commit", rec)
+	}
+}
+
+func TestGitLabVerify(t *testing.T) {
+	conf = newSecretsConfig(t, webhookSecret{Prefix: "gitlab.company.com/group", Secret: "token"})
+	cases := []struct {
+		name  string
+		repo  string
+		token string
+		want  error
+	}{
+		{"valid token", "gitlab.company.com/group/repo", "token", nil},
+		{"wrong token", "gitlab.company.com/group/repo", "other", errSignatureMismatch},
+		{"no token", "gitlab.company.com/group/repo", "", errSignatureMissing},
+		{"uncovered repo", "gitlab.company.com/other/repo", "token", errSignatureNoSecret},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/hook", nil)
+		if tc.token != "" {
+			r.Header.Set(gitlabTokenHeader, tc.token)
+		}
+		if got := (gitlabProvider{}).verify(r, nil, tc.repo); got != tc.want {
+			t.Errorf("%s: verify = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
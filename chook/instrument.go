@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rendicott/goarder/internal/common"
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+var (
+	webhooksTotal = common.NewCounterVec("chook_webhooks_total",
+		"Webhooks received by provider, event and outcome.",
+		"provider", "event", "outcome")
+	signatureFailuresTotal = common.NewCounterVec("chook_signature_failures_total",
+		"Webhooks rejected because of a missing or invalid signature.",
+		"provider")
+	registryDuration = common.NewHistogramVec("chook_registry_operation_duration_seconds",
+		"Latency of registry operations.",
+		"backend", "operation")
+	registryErrorsTotal = common.NewCounterVec("chook_registry_operation_errors_total",
+		"Registry operations that returned an error.",
+		"backend", "operation")
+	triggerValue = common.NewGaugeVec("chook_trigger",
+		"Last trigger count read from or written to the registry.")
+	duplicateDeliveriesTotal = common.NewCounterVec("chook_duplicate_deliveries_total",
+		"Webhook deliveries skipped because they were already processed.",
+		"provider")
+)
+
+// knownEvents are the event names the providers handle.
+// Event names come from the sender so any other name is
+// counted as "other" to keep the number of series bounded.
+var knownEvents = map[string]bool{
+	"ping":              true,
+	"push":              true,
+	"repository":        true,
+	"release":           true,
+	"create":            true,
+	"tag_push":          true,
+	"project_destroy":   true,
+	"repo:refs_changed": true,
+	"diagnostics:ping":  true,
+}
+
+// eventLabel returns the event label for an event called name
+func eventLabel(name string) string {
+	if knownEvents[name] {
+		return name
+	}
+	return "other"
+}
+
+// hookOutcome describes how a hook was answered based on
+// the status code that was sent for it
+func hookOutcome(w http.ResponseWriter) string {
+	status := responseStatus(w)
+	switch {
+	case status == http.StatusAccepted:
+		return "ignored"
+	case status < 300:
+		return "processed"
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status < 500:
+		return "invalid"
+	}
+	return "error"
+}
+
+// instrumentedRegistry records the latency and errors of
+// every operation of the registry it wraps
+type instrumentedRegistry struct {
+	backend string
+	next    registry.Registry
+}
+
+func newInstrumentedRegistry(backend string, next registry.Registry) *instrumentedRegistry {
+	return &instrumentedRegistry{backend: backend, next: next}
+}
+
+// observe records an operation that started at start.
+// Repos that aren't registered are an expected answer
+// rather than an error.
+func (i *instrumentedRegistry) observe(operation string, start time.Time, err error) {
+	registryDuration.Observe(time.Since(start).Seconds(), i.backend, operation)
+	if err != nil && err != registry.ErrRepoNotRegistered {
+		registryErrorsTotal.Inc(i.backend, operation)
+	}
+}
+
+func (i *instrumentedRegistry) PutRepo(rec registry.Record) (err error) {
+	start := time.Now()
+	err = i.next.PutRepo(rec)
+	i.observe("putRepo", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) DeleteRepo(repo string) (err error) {
+	start := time.Now()
+	err = i.next.DeleteRepo(repo)
+	i.observe("deleteRepo", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) SetRepoAttribute(repo, attribute, value string) (err error) {
+	start := time.Now()
+	err = i.next.SetRepoAttribute(repo, attribute, value)
+	i.observe("setRepoAttribute", start, err)
+	return err
+}
+
+func (i *instrumentedRegistry) GetRepo(repo string) (rec registry.Record, err error) {
+	start := time.Now()
+	rec, err = i.next.GetRepo(repo)
+	i.observe("getRepo", start, err)
+	return rec, err
+}
+
+func (i *instrumentedRegistry) ListRepos() (recs []registry.Record, err error) {
+	start := time.Now()
+	recs, err = i.next.ListRepos()
+	i.observe("listRepos", start, err)
+	return recs, err
+}
+
+func (i *instrumentedRegistry) BumpTrigger() (count int, err error) {
+	start := time.Now()
+	count, err = i.next.BumpTrigger()
+	i.observe("bumpTrigger", start, err)
+	if err == nil {
+		triggerValue.Set(float64(count))
+	}
+	return count, err
+}
+
+func (i *instrumentedRegistry) GetTrigger() (count int, err error) {
+	start := time.Now()
+	count, err = i.next.GetTrigger()
+	i.observe("getTrigger", start, err)
+	if err == nil {
+		triggerValue.Set(float64(count))
+	}
+	return count, err
+}
+
+func (i *instrumentedRegistry) DeliverySeen(id string) (seen bool, err error) {
+	start := time.Now()
+	seen, err = i.next.DeliverySeen(id)
+	i.observe("deliverySeen", start, err)
+	return seen, err
+}
+
+func (i *instrumentedRegistry) ClaimDelivery(id string, expires time.Time) (claimed bool, err error) {
+	start := time.Now()
+	claimed, err = i.next.ClaimDelivery(id, expires)
+	i.observe("claimDelivery", start, err)
+	return claimed, err
+}
+
+func (i *instrumentedRegistry) ReleaseDelivery(id string) (err error) {
+	start := time.Now()
+	err = i.next.ReleaseDelivery(id)
+	i.observe("releaseDelivery", start, err)
+	return err
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestEventLabel(t *testing.T) {
+	cases := map[string]string{
+		"push":              "push",
+		"repo:refs_changed": "repo:refs_changed",
+		"tag_push":          "tag_push",
+		"issues":            "other",
+		"":                  "other",
+		"x-random-1234":     "other",
+	}
+	for name, want := range cases {
+		if got := eventLabel(name); got != want {
+			t.Errorf("eventLabel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
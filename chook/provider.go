@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// webhookProvider is implemented by each type of git server
+// that chook can accept webhooks from
+type webhookProvider interface {
+	// name identifies the provider in the config and routes
+	name() string
+	// detect reports whether r was sent by this provider
+	detect(r *http.Request) bool
+	// parse decodes body into a normalized event
+	parse(r *http.Request, body []byte) (ev hookEvent, err error)
+	// verify checks that r was signed with one of the
+	// secrets configured for repo
+	verify(r *http.Request, body []byte, repo string) error
+}
+
+// providers lists every known provider in the order they are
+// tried when detecting from headers. GitHub goes last since
+// Gitea sends GitHub's headers too.
+var providers = []webhookProvider{
+	gitlabProvider{},
+	bitbucketProvider{},
+	giteaProvider{},
+	githubProvider{},
+}
+
+// providerByName returns the provider called name
+// or nil if there is no such provider
+func providerByName(name string) webhookProvider {
+	for _, p := range providers {
+		if p.name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// providerEnabled reports whether hooks from the
+// provider called name are accepted
+func (c *config) providerEnabled(name string) bool {
+	for _, p := range c.Providers {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// detectProvider returns the enabled provider that sent r.
+// Hooks that no provider recognizes are treated as GitHub
+// hooks like they always were.
+func detectProvider(r *http.Request) webhookProvider {
+	for _, p := range providers {
+		if conf.providerEnabled(p.name()) && p.detect(r) {
+			return p
+		}
+	}
+	if conf.providerEnabled("github") {
+		return githubProvider{}
+	}
+	return nil
+}
+
+// handlerProviderRoute serves /hook/{provider} and
+// /delete/{provider} so that a route only accepts hooks
+// from a single provider
+func handlerProviderRoute(w http.ResponseWriter, r *http.Request) {
+	del := strings.HasPrefix(r.URL.Path, "/delete/")
+	name := path.Base(r.URL.Path)
+	p := providerByName(name)
+	if p == nil || !conf.providerEnabled(name) {
+		writeHookError(w, http.StatusNotFound, nil, fmt.Sprintf("provider '%s' is not enabled", name))
+		return
+	}
+	handlerCreateDelete(w, r, del, p)
+}
+
+// handleHook parses and verifies body with provider p, or the
+// provider detected from the headers if p is nil, and then
+// hands the event to the handler for its kind
+func handleHook(w http.ResponseWriter, r *http.Request, body []byte, del bool, p webhookProvider) {
+	provider, event, outcome := "unknown", "unknown", ""
+	defer func() {
+		if outcome == "" {
+			outcome = hookOutcome(w)
+		}
+		webhooksTotal.Inc(provider, event, outcome)
+	}()
+	if p == nil {
+		p = detectProvider(r)
+	}
+	if p == nil {
+		writeHookError(w, http.StatusBadRequest, nil, "unrecognized webhook")
+		reqLog(w).Infof("no enabled provider recognized the hook")
+		return
+	}
+	provider = p.name()
+	ev, err := p.parse(r, body)
+	if err != nil {
+		writeHookError(w, http.StatusBadRequest, &hookEvent{Provider: p.name()}, fmt.Sprintf("could not parse %s hook", p.name()))
+		reqLog(w).Errorf("Error parsing %s hook: %s", p.name(), err.Error())
+		return
+	}
+	ev.Provider = p.name()
+	event = eventLabel(ev.Name)
+	// the repo name selects which secret to verify with
+	// so attempt to derive it before checking the signature
+	if len(ev.URL) > 0 {
+		setRepo(&ev.Record, ev.URL)
+	}
+	err = p.verify(r, body, ev.Record.Repo)
+	if err != nil {
+		signatureFailuresTotal.Inc(ev.Provider)
+		writeHookError(w, http.StatusUnauthorized, &ev, "invalid webhook signature")
+		reqLog(w).Warnf("Rejecting %s hook for repo '%s': %s", ev.Provider, ev.Record.Repo, err.Error())
+		return
+	}
+	reqLog(w).Infof("received %s event '%s'", ev.Provider, ev.Name)
+	if ev.Record.Repo != "" {
+		err = conf.repoRules.Check(ev.Record.Repo)
+		if err != nil {
+			writeHookError(w, http.StatusForbidden, &ev, err.Error())
+			reqLog(w).Warnf("Rejecting %s hook: %s", ev.Provider, err.Error())
+			return
+		}
+		err = checkRecord(ev.Record)
+		if err != nil {
+			writeHookError(w, http.StatusBadRequest, &ev, err.Error())
+			reqLog(w).Warnf("Rejecting %s hook: %s", ev.Provider, err.Error())
+			return
+		}
+	}
+	if ev.Kind == kindPush && !conf.refAccepted(ev.Ref, ev.DefaultBranch) {
+		if ev.DefaultBranch == "" && !hasExplicitRefs(conf.AcceptedRefs) {
+			ev.ignore("push to '%s' is ignored since %s hooks don't send the default branch, list the branches in accepted_refs", ev.Ref, ev.Provider)
+		} else {
+			ev.ignore("push to '%s' does not match accepted_refs, ignoring", ev.Ref)
+		}
+	}
+	if _, ok := eventHandlers[ev.Kind]; !ok {
+		writeHook(w, http.StatusAccepted, &ev, hookResponse{Action: actionIgnored, Reason: ev.Reason})
+		reqLog(w).Infof("ignoring %s event '%s': %s", ev.Provider, ev.Name, ev.Reason)
+		return
+	}
+	// pings are answered with our config so they
+	// can't wait in the queue
+	if queue == nil || ev.Kind == kindPing {
+		processEvent(w, &ev, del)
+		return
+	}
+	if duplicateDelivery(w, &ev) {
+		return
+	}
+	if enqueueEvent(w, &ev, del) {
+		outcome = "queued"
+	}
+}
+
+// processEvent hands ev to the handler for its kind unless it
+// is a delivery that was already processed. The delivery is
+// claimed before the handler runs so that two copies of it
+// arriving at once can't both be processed, and released if
+// the handler fails so it can be retried.
+func processEvent(w http.ResponseWriter, ev *hookEvent, del bool) {
+	handler := eventHandlers[ev.Kind]
+	if ev.Delivery == "" {
+		handler(w, ev, del)
+		return
+	}
+	expires := time.Now().Add(time.Duration(conf.DeliveryTTL) * time.Second)
+	claimed, err := reg.ClaimDelivery(ev.Delivery, expires)
+	if err != nil {
+		// worst case the hook is processed twice
+		reqLog(w).Warnf("Error claiming delivery '%s': %s", ev.Delivery, err.Error())
+	} else if !claimed {
+		writeDuplicate(w, ev)
+		return
+	}
+	ev.Record.LastDelivery = ev.Delivery
+	handler(w, ev, del)
+	if responseStatus(w) == http.StatusOK || !claimed {
+		return
+	}
+	// let failed deliveries be retried
+	err = reg.ReleaseDelivery(ev.Delivery)
+	if err != nil {
+		reqLog(w).Warnf("Error releasing delivery '%s': %s", ev.Delivery, err.Error())
+	}
+}
+
+// duplicateDelivery answers ev if its delivery was already
+// claimed. Retried and redelivered hooks keep their delivery
+// ID and shouldn't cause ahoy to sync again. It only saves
+// queueing the hook, processEvent claims the delivery.
+func duplicateDelivery(w http.ResponseWriter, ev *hookEvent) bool {
+	if ev.Delivery == "" {
+		return false
+	}
+	seen, err := reg.DeliverySeen(ev.Delivery)
+	if err != nil {
+		reqLog(w).Warnf("Error checking delivery '%s': %s", ev.Delivery, err.Error())
+	}
+	if seen {
+		writeDuplicate(w, ev)
+	}
+	return seen
+}
+
+// writeDuplicate answers ev as a delivery that
+// was already processed
+func writeDuplicate(w http.ResponseWriter, ev *hookEvent) {
+	duplicateDeliveriesTotal.Inc(ev.Provider)
+	writeHook(w, http.StatusOK, ev, hookResponse{Action: actionDuplicate, Reason: "already processed"})
+	reqLog(w).Infof("skipping %s delivery '%s' which was already processed", ev.Provider, ev.Delivery)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/rendicott/goarder/internal/common"
+)
+
+// apiQueuePath is the path of the endpoint that describes
+// the hook queue
+const apiQueuePath = "/api/queue"
+
+// bounds of the delay before a failed hook is retried which
+// doubles with every attempt
+const (
+	queueBackoffMin = time.Second
+	queueBackoffMax = 5 * time.Minute
+)
+
+// queueDeadLimit is the most dead-lettered hooks
+// returned by apiQueuePath
+const queueDeadLimit = 100
+
+var (
+	queueJobsBucket = []byte("jobs")
+	queueDeadBucket = []byte("dead")
+)
+
+var (
+	queueDepth = common.NewGaugeVec("chook_queue_depth",
+		"Hooks waiting in the queue to be applied, including ones being retried.")
+	queueDeadLetters = common.NewGaugeVec("chook_queue_dead_letters",
+		"Hooks that ran out of attempts or failed permanently.")
+	queueJobsTotal = common.NewCounterVec("chook_queue_jobs_total",
+		"Attempts to apply queued hooks by outcome: processed, retried or dead.",
+		"outcome")
+)
+
+// queue is set up in main() if queue_path is configured.
+// When it is nil hooks are applied while the request waits.
+var queue *hookQueue
+
+// queuedHook is a hook waiting to be applied to the registry
+type queuedHook struct {
+	ID uint64 `json:"id"`
+	// RequestID is the ID of the request the hook arrived
+	// on so its log lines can be tied together
+	RequestID   string    `json:"requestId"`
+	Event       hookEvent `json:"event"`
+	Delete      bool      `json:"delete"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// hookQueue is a durable queue of hooks kept in a local bbolt
+// database. Hooks are answered as soon as they are queued and
+// a pool of workers applies them to the registry, retrying
+// with exponential backoff until they succeed or run out of
+// attempts and are dead-lettered.
+type hookQueue struct {
+	db          *bolt.DB
+	maxAttempts int
+	ready       chan queuedHook
+	wake        chan struct{}
+	quit        chan struct{}
+	wg          sync.WaitGroup
+
+	// inFlight holds the IDs of hooks handed to a worker
+	// so they aren't dispatched twice
+	mu       sync.Mutex
+	inFlight map[uint64]bool
+}
+
+// queueLockTimeout is how long to wait for the lock on the
+// queue database before giving up
+const queueLockTimeout = 10 * time.Second
+
+// openHookQueue opens or creates the queue database at path.
+// Hooks left in it by a previous run are picked up once the
+// workers are started.
+func openHookQueue(path string, maxAttempts int) (q *hookQueue, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: queueLockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{queueJobsBucket, queueDeadBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	q = &hookQueue{
+		db:          db,
+		maxAttempts: maxAttempts,
+		ready:       make(chan queuedHook),
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		inFlight:    make(map[uint64]bool),
+	}
+	q.updateGauges()
+	return q, err
+}
+
+// queueKey returns the key of the hook with the given ID.
+// Keys are big endian so hooks are iterated oldest first.
+func queueKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// start runs the dispatcher and the given number of workers
+func (q *hookQueue) start(workers int) {
+	q.wg.Add(1)
+	go q.dispatch()
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// close stops handing out hooks and waits up to timeout for
+// the workers to finish the ones they are applying. Hooks
+// that are still queued are applied on the next start.
+func (q *hookQueue) close(timeout time.Duration) {
+	close(q.quit)
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Infof("hook queue workers stopped")
+	case <-time.After(timeout):
+		log.Warnf("hook queue workers did not stop within %s", timeout)
+	}
+	q.db.Close()
+}
+
+// enqueue stores ev so it survives a restart and wakes the
+// dispatcher. requestID is the ID of the request ev came on.
+func (q *hookQueue) enqueue(ev *hookEvent, del bool, requestID string) (job queuedHook, err error) {
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(queueJobsBucket)
+		id, err := jobs.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		job = queuedHook{
+			ID:          id,
+			RequestID:   requestID,
+			Event:       *ev,
+			Delete:      del,
+			Queued:      now,
+			NextAttempt: now,
+		}
+		v, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return jobs.Put(queueKey(id), v)
+	})
+	if err != nil {
+		return job, err
+	}
+	q.updateGauges()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, err
+}
+
+// dispatch hands hooks that are due to the workers. It looks
+// for them whenever a hook is queued and once a second so
+// retries are picked up when their backoff has passed.
+func (q *hookQueue) dispatch() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		jobs, err := q.due(time.Now())
+		if err != nil {
+			log.Errorf("Error reading hook queue: %s", err.Error())
+		}
+		for _, job := range jobs {
+			select {
+			case q.ready <- job:
+			case <-q.quit:
+				return
+			}
+		}
+		select {
+		case <-q.quit:
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// due returns the queued hooks whose next attempt is before
+// now and that aren't being applied already, and marks them
+// as in flight. Hooks for a repo are applied one at a time in
+// the order they arrived so a hook that is being retried
+// holds back the newer hooks for its repo, otherwise a retry
+// could overwrite the commit of a newer push.
+func (q *hookQueue) due(now time.Time) (jobs []queuedHook, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// waiting holds the repos that have an older
+	// hook in flight or waiting to be retried
+	waiting := make(map[string]bool)
+	err = q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueJobsBucket).ForEach(func(k, v []byte) error {
+			var job queuedHook
+			err := json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			repo := job.Event.Record.Repo
+			blocked := repo != "" && waiting[repo]
+			if repo != "" {
+				waiting[repo] = true
+			}
+			if blocked || q.inFlight[job.ID] || job.NextAttempt.After(now) {
+				return nil
+			}
+			q.inFlight[job.ID] = true
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// work applies hooks until the queue is closed
+func (q *hookQueue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.quit:
+			return
+		case job := <-q.ready:
+			q.apply(job)
+		}
+	}
+}
+
+// apply runs the handler for the kind of the queued hook and
+// then removes it from the queue, schedules a retry or moves
+// it to the dead letters depending on how that went
+func (q *hookQueue) apply(job queuedHook) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.inFlight, job.ID)
+		q.mu.Unlock()
+	}()
+	lg := log.With("request_id", job.RequestID).With("job_id", job.ID)
+	rec := &queueResponseWriter{header: make(http.Header)}
+	lw := &logResponseWriter{ResponseWriter: rec, log: lg}
+	processEvent(lw, &job.Event, job.Delete)
+	status := responseStatus(lw)
+	job.Attempts++
+	var err error
+	switch {
+	case status < 300:
+		queueJobsTotal.Inc("processed")
+		lg.Infof("applied queued %s hook for repo '%s' after %d attempt(s)", job.Event.Name, job.Event.Record.Repo, job.Attempts)
+		err = q.remove(job)
+	case status < 500 || job.Attempts >= q.maxAttempts:
+		// client errors won't go away by trying again
+		job.LastError = rec.reason()
+		queueJobsTotal.Inc("dead")
+		lg.Errorf("giving up on queued %s hook for repo '%s' after %d attempt(s): %s", job.Event.Name, job.Event.Record.Repo, job.Attempts, job.LastError)
+		err = q.bury(job)
+	default:
+		job.LastError = rec.reason()
+		delay := queueBackoff(job.Attempts)
+		job.NextAttempt = time.Now().UTC().Add(delay)
+		queueJobsTotal.Inc("retried")
+		lg.Warnf("retrying queued %s hook for repo '%s' in %s: %s", job.Event.Name, job.Event.Record.Repo, delay, job.LastError)
+		err = q.put(job)
+	}
+	if err != nil {
+		lg.Errorf("Error updating hook queue: %s", err.Error())
+	}
+	q.updateGauges()
+}
+
+// queueBackoff returns how long to wait before the next
+// attempt once a hook has failed attempts times
+func queueBackoff(attempts int) time.Duration {
+	delay := queueBackoffMin
+	for i := 1; i < attempts && delay < queueBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > queueBackoffMax {
+		delay = queueBackoffMax
+	}
+	return delay
+}
+
+// put stores job in the queue, replacing the previous
+// attempt if there was one
+func (q *hookQueue) put(job queuedHook) (err error) {
+	v, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueJobsBucket).Put(queueKey(job.ID), v)
+	})
+}
+
+// remove deletes job from the queue
+func (q *hookQueue) remove(job queuedHook) (err error) {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueJobsBucket).Delete(queueKey(job.ID))
+	})
+}
+
+// bury moves job from the queue to the dead letters
+func (q *hookQueue) bury(job queuedHook) (err error) {
+	v, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(queueDeadBucket).Put(queueKey(job.ID), v)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(queueJobsBucket).Delete(queueKey(job.ID))
+	})
+}
+
+// queueStatus describes the queue as returned by apiQueuePath
+type queueStatus struct {
+	Depth       int          `json:"depth"`
+	InFlight    int          `json:"inFlight"`
+	DeadLetters int          `json:"deadLetters"`
+	Dead        []queuedHook `json:"dead"`
+}
+
+// status returns the size of the queue and the most
+// recent dead letters, newest first
+func (q *hookQueue) status() (s queueStatus, err error) {
+	q.mu.Lock()
+	s.InFlight = len(q.inFlight)
+	q.mu.Unlock()
+	s.Dead = []queuedHook{}
+	err = q.db.View(func(tx *bolt.Tx) error {
+		s.Depth = tx.Bucket(queueJobsBucket).Stats().KeyN
+		dead := tx.Bucket(queueDeadBucket)
+		s.DeadLetters = dead.Stats().KeyN
+		c := dead.Cursor()
+		for k, v := c.Last(); k != nil && len(s.Dead) < queueDeadLimit; k, v = c.Prev() {
+			var job queuedHook
+			err := json.Unmarshal(v, &job)
+			if err != nil {
+				return err
+			}
+			s.Dead = append(s.Dead, job)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// updateGauges sets the queue metrics from the database
+func (q *hookQueue) updateGauges() {
+	q.db.View(func(tx *bolt.Tx) error {
+		queueDepth.Set(float64(tx.Bucket(queueJobsBucket).Stats().KeyN))
+		queueDeadLetters.Set(float64(tx.Bucket(queueDeadBucket).Stats().KeyN))
+		return nil
+	})
+}
+
+// queueResponseWriter takes the place of the client's
+// connection when a queued hook is applied and keeps the
+// response so failures can be recorded
+type queueResponseWriter struct {
+	header http.Header
+	body   strings.Builder
+}
+
+func (rw *queueResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *queueResponseWriter) Write(b []byte) (int, error) {
+	return rw.body.Write(b)
+}
+
+func (rw *queueResponseWriter) WriteHeader(code int) {}
+
+// reason returns why the hook failed according to
+// the response its handler wrote
+func (rw *queueResponseWriter) reason() string {
+	var resp hookResponse
+	err := json.Unmarshal([]byte(rw.body.String()), &resp)
+	if err != nil || resp.Reason == "" {
+		return strings.TrimSpace(rw.body.String())
+	}
+	return resp.Reason
+}
+
+// enqueueEvent queues ev to be applied by the workers
+// and tells the sender it was accepted
+func enqueueEvent(w http.ResponseWriter, ev *hookEvent, del bool) (ok bool) {
+	job, err := queue.enqueue(ev, del, w.Header().Get(requestIDHeader))
+	if err != nil {
+		writeHookError(w, http.StatusInternalServerError, ev, "could not queue hook")
+		reqLog(w).Errorf("Error queueing hook: %s", err.Error())
+		return false
+	}
+	reqLog(w).With("job_id", job.ID).Infof("queued %s event '%s' for repo '%s'", ev.Provider, ev.Name, ev.Record.Repo)
+	writeHook(w, http.StatusAccepted, ev, hookResponse{Action: actionQueued})
+	return true
+}
+
+// handlerAPIQueue serves GET /api/queue which returns the
+// number of queued hooks and the most recent dead letters.
+// Dead letters hold whole hook events so it needs an admin
+// token.
+func handlerAPIQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method "+r.Method+" not allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if queue == nil {
+		writeJSONError(w, http.StatusNotFound, "the hook queue is not enabled, set queue_path")
+		return
+	}
+	s, err := queue.status()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not read hook queue")
+		reqLog(w).Errorf("Error reading hook queue: %s", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
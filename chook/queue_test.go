@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// dueRepos returns the repos of the hooks that are due
+func dueRepos(t *testing.T, q *hookQueue, now time.Time) (repos []string) {
+	t.Helper()
+	jobs, err := q.due(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		repos = append(repos, job.Event.Record.Repo)
+	}
+	return repos
+}
+
+func TestQueueDueInOrderPerRepo(t *testing.T) {
+	q, err := openHookQueue(filepath.Join(t.TempDir(), "queue.db"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.db.Close()
+	var jobs []queuedHook
+	for _, repo := range []string{"github.company.com/Org/a", "github.company.com/Org/a", "github.company.com/Org/b"} {
+		ev := &hookEvent{Kind: kindPush, Record: registry.Record{Repo: repo}}
+		job, err := q.enqueue(ev, false, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+	now := time.Now()
+	// the second hook for a waits for the first
+	got := dueRepos(t, q, now)
+	if len(got) != 2 || got[0] != "github.company.com/Org/a" || got[1] != "github.company.com/Org/b" {
+		t.Fatalf("due = %v, want the first hook of each repo", got)
+	}
+	if got := dueRepos(t, q, now); len(got) != 0 {
+		t.Fatalf("due = %v while the hooks are in flight", got)
+	}
+	// the first hook for a fails and is retried later which
+	// still holds back the second one
+	first := jobs[0]
+	first.NextAttempt = now.Add(time.Minute)
+	if err := q.put(first); err != nil {
+		t.Fatal(err)
+	}
+	delete(q.inFlight, first.ID)
+	if got := dueRepos(t, q, now); len(got) != 0 {
+		t.Fatalf("due = %v while an older hook for the repo is waiting to be retried", got)
+	}
+	// once it is applied the second one is due
+	if err := q.remove(first); err != nil {
+		t.Fatal(err)
+	}
+	got = dueRepos(t, q, now)
+	if len(got) != 1 || got[0] != "github.company.com/Org/a" {
+		t.Fatalf("due = %v, want the second hook of a", got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// refDefaultBranch can be used in accepted_refs to stand for
+// the default branch of the repo as sent in the hook payload
+const refDefaultBranch = "default"
+
+// checkRefPatterns makes sure every accepted_refs pattern
+// is valid so that bad patterns fail at startup instead of
+// when a hook arrives
+func checkRefPatterns(patterns []string) (err error) {
+	for _, p := range patterns {
+		if p == refDefaultBranch {
+			continue
+		}
+		_, err = path.Match(p, "refs/heads/master")
+		if err != nil {
+			err = fmt.Errorf("invalid accepted_refs pattern '%s': %s", p, err.Error())
+			return err
+		}
+	}
+	return err
+}
+
+// hasExplicitRefs reports whether patterns accept any ref
+// without relying on the default branch from the payload
+func hasExplicitRefs(patterns []string) bool {
+	for _, p := range patterns {
+		if p != refDefaultBranch {
+			return true
+		}
+	}
+	return false
+}
+
+// refAccepted tells whether a push to ref should register
+// the repo and bump the trigger. Patterns are globs matched
+// against the full ref, e.g., refs/heads/release/*. With no
+// patterns configured only the default branch is accepted.
+// Providers that don't send the default branch (Bitbucket
+// Server) never match it so their branches have to be listed
+// explicitly.
+func (c *config) refAccepted(ref, defaultBranch string) bool {
+	patterns := c.AcceptedRefs
+	if len(patterns) == 0 {
+		patterns = []string{refDefaultBranch}
+	}
+	for _, p := range patterns {
+		if p == refDefaultBranch {
+			if defaultBranch == "" {
+				continue
+			}
+			if ref == defaultBranch || ref == "refs/heads/"+strings.TrimPrefix(defaultBranch, "refs/heads/") {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, ref); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestRefAccepted(t *testing.T) {
+	cases := []struct {
+		name          string
+		patterns      []string
+		ref           string
+		defaultBranch string
+		want          bool
+	}{
+		{"default branch by default", nil, "refs/heads/main", "main", true},
+		{"other branch by default", nil, "refs/heads/feature", "main", false},
+		{"default branch sent as a ref", nil, "refs/heads/main", "refs/heads/main", true},
+		{"no default branch in the payload", nil, "refs/heads/main", "", false},
+		{"tag by default", nil, "refs/tags/v1.0.0", "main", false},
+		{"release branch glob", []string{"refs/heads/release/*"}, "refs/heads/release/1.2", "main", true},
+		{"glob doesn't cross slashes", []string{"refs/heads/release/*"}, "refs/heads/release/1.2/hotfix", "main", false},
+		{"default not listed", []string{"refs/heads/release/*"}, "refs/heads/main", "main", false},
+		{"default and releases", []string{"default", "refs/heads/release/*"}, "refs/heads/main", "main", true},
+		{"tags", []string{"refs/tags/v*"}, "refs/tags/v1.0.0", "main", true},
+		{"tags glob on a branch", []string{"refs/tags/v*"}, "refs/heads/v1", "main", false},
+		{"explicit branch without default from payload", []string{"refs/heads/master"}, "refs/heads/master", "", true},
+	}
+	for _, tc := range cases {
+		c := &config{AcceptedRefs: tc.patterns}
+		if got := c.refAccepted(tc.ref, tc.defaultBranch); got != tc.want {
+			t.Errorf("%s: refAccepted(%q, %q) = %t, want %t", tc.name, tc.ref, tc.defaultBranch, got, tc.want)
+		}
+	}
+}
+
+func TestCheckRefPatterns(t *testing.T) {
+	if err := checkRefPatterns([]string{"default", "refs/heads/release/*", "refs/tags/v[0-9]*"}); err != nil {
+		t.Errorf("checkRefPatterns rejected valid patterns: %s", err)
+	}
+	if err := checkRefPatterns([]string{"refs/heads/[release"}); err == nil {
+		t.Error("checkRefPatterns accepted an invalid pattern")
+	}
+	if hasExplicitRefs([]string{"default"}) || !hasExplicitRefs([]string{"default", "refs/heads/main"}) {
+		t.Error("hasExplicitRefs doesn't tell the default branch from explicit patterns")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rendicott/goarder/internal/registry"
+)
+
+// errTriggerKeyProtected is returned when a hook or admin
+// request tries to modify the repo used as the trigger key
+var errTriggerKeyProtected = errors.New("cannot modify trigger key with hook methods")
+
+// reg is the registry selected by the backend config
+// directive and is set up in main()
+var reg registry.Registry
+
+// newRegistry returns the registry for the backend
+// configured in c
+func newRegistry(c *config) (registry.Registry, error) {
+	switch c.Backend {
+	case registry.BackendDynamoDB:
+		return registry.NewDynamo(c.DynamoDBRegion, c.DynamoDBTable, c.DynamoDBtriggerKey)
+	case registry.BackendLocal:
+		return registry.NewBolt(c.LocalDBPath), nil
+	}
+	return nil, fmt.Errorf("unknown backend '%s'", c.Backend)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/rendicott/goarder/internal/common"
+)
+
+// requestIDHeader carries the ID of each request. It is
+// taken from the request if a proxy already set it and is
+// always sent back on the response.
+const requestIDHeader = "X-Request-Id"
+
+// newRequestID returns a random ID for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// logResponseWriter carries the logger of a request to
+// the handlers and remembers the status they sent
+type logResponseWriter struct {
+	http.ResponseWriter
+	log    *common.Logger
+	status int
+}
+
+func (lw *logResponseWriter) WriteHeader(code int) {
+	if lw.status == 0 {
+		lw.status = code
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *logResponseWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+// responseStatus returns the status code that was sent
+// through w so far
+func responseStatus(w http.ResponseWriter) int {
+	if lw, ok := w.(*logResponseWriter); ok && lw.status != 0 {
+		return lw.status
+	}
+	return http.StatusOK
+}
+
+// reqLog returns the logger of the request being
+// answered through w
+func reqLog(w http.ResponseWriter) *common.Logger {
+	if lw, ok := w.(*logResponseWriter); ok {
+		return lw.log
+	}
+	return log
+}
+
+// withRequestLog gives every request an ID which is added
+// to everything logged while handling it and logs the
+// outcome once it has been handled
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		lw := &logResponseWriter{
+			ResponseWriter: w,
+			log:            log.With("request_id", id),
+		}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		l := lw.log.With("method", r.Method).
+			With("path", r.URL.Path).
+			With("status", lw.status).
+			With("duration_ms", time.Since(start).Milliseconds())
+		if r.URL.Path == "/" {
+			// load balancer health checks would drown
+			// out everything else
+			l.Debugf("handled request")
+			return
+		}
+		l.Infof("handled request")
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+)
+
+// actions reported in hook responses
+const (
+	actionCreated   = "created"
+	actionDeleted   = "deleted"
+	actionRecorded  = "recorded"
+	actionIgnored   = "ignored"
+	actionPong      = "pong"
+	actionDuplicate = "duplicate"
+	actionQueued    = "queued"
+	actionRejected  = "rejected"
+	actionFailed    = "failed"
+)
+
+// hookResponse is the JSON body of every response to a hook
+// so that the delivery log of the git server shows what
+// chook did with it
+type hookResponse struct {
+	Provider string `json:"provider,omitempty"`
+	Event    string `json:"event,omitempty"`
+	Delivery string `json:"delivery,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason,omitempty"`
+	Trigger  int    `json:"trigger,omitempty"`
+}
+
+// writeHook writes resp to w with the details of ev filled
+// in. ev is nil if the hook couldn't be parsed.
+func writeHook(w http.ResponseWriter, code int, ev *hookEvent, resp hookResponse) {
+	if ev != nil {
+		resp.Provider = ev.Provider
+		resp.Event = ev.Name
+		resp.Delivery = ev.Delivery
+		resp.Repo = ev.Record.Repo
+	}
+	writeJSON(w, code, resp)
+}
+
+// writeHookError writes a response for a hook that was
+// rejected (4xx) or that failed (5xx)
+func writeHookError(w http.ResponseWriter, code int, ev *hookEvent, reason string) {
+	action := actionRejected
+	if code >= http.StatusInternalServerError {
+		action = actionFailed
+	}
+	writeHook(w, code, ev, hookResponse{Action: action, Reason: reason})
+}
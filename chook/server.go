@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	stdlog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// serverErrorWriter sends errors logged by the http.Server
+// itself, e.g., failed TLS handshakes, to our logger
+type serverErrorWriter struct{}
+
+func (serverErrorWriter) Write(p []byte) (int, error) {
+	log.Warnf("%s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// newServer returns the server for handler configured
+// with the timeouts from c
+func newServer(c *config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              c.ListenString,
+		Handler:           withMaxBody(c.MaxBodyBytes, handler),
+		ReadTimeout:       time.Duration(c.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(c.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(c.IdleTimeout) * time.Second,
+		ErrorLog:          stdlog.New(serverErrorWriter{}, "", 0),
+	}
+}
+
+// withMaxBody stops handlers from reading more
+// than limit bytes of any request body
+func withMaxBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs srv until it fails or a SIGINT or SIGTERM
+// is received. On a signal it stops accepting requests and
+// waits up to timeout for the ones in flight to finish so
+// registry writes aren't cut off half way.
+func serve(srv *http.Server, timeout time.Duration) (err error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() {
+		sig := <-sigs
+		log.Infof("received signal '%s', draining requests for up to %s", sig, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+	if srv.TLSConfig != nil {
+		// the certificate comes from TLSConfig.GetCertificate
+		log.Infof("listening on %s with TLS", srv.Addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Infof("listening on %s", srv.Addr)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	err = <-done
+	if err == nil {
+		log.Infof("all requests drained, exiting")
+	}
+	return err
+}
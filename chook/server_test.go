@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxBody(t *testing.T) {
+	conf = &config{MaxBodyBytes: 16}
+	handler := withMaxBody(conf.MaxBodyBytes, http.HandlerFunc(handlerCreate))
+	body := `{"ref":"refs/heads/master","padding":"xxxxxxxx"}`
+	for _, chunked := range []bool{false, true} {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+		if chunked {
+			// a chunked body has no length up front
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunked=%t: status = %d, want %d", chunked, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
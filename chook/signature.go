@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	errSignatureMissing  = errors.New("request is missing signature header")
+	errSignatureMismatch = errors.New("request signature does not match any configured secret")
+	errSignatureNoSecret = errors.New("no webhook secret is configured for the repo")
+)
+
+// webhookSecret holds a secret used to verify incoming
+// webhooks. Prefix scopes the secret to repos whose derived
+// name (e.g., github.company.com/Org) starts with it so
+// different servers or orgs can use different secrets. An
+// empty prefix matches every repo.
+//
+// Previous can be set while rotating a secret so that hooks
+// signed with either value are accepted. If PreviousUntil is set
+// (RFC3339) the previous secret stops being accepted after
+// that time.
+type webhookSecret struct {
+	Prefix        string `yaml:"prefix"`
+	Secret        string `yaml:"secret"`
+	Previous      string `yaml:"previous"`
+	PreviousUntil string `yaml:"previous_until"`
+	previousUntil time.Time
+}
+
+// setDefaults parses the grace period for the previous
+// secret and validates the entry.
+func (s *webhookSecret) setDefaults() (err error) {
+	if s.Secret == "" {
+		err = fmt.Errorf("webhook secret for prefix '%s' is empty", s.Prefix)
+		return err
+	}
+	if s.PreviousUntil != "" {
+		s.previousUntil, err = time.Parse(time.RFC3339, s.PreviousUntil)
+		if err != nil {
+			err = fmt.Errorf("error parsing previous_until for prefix '%s': %s", s.Prefix, err.Error())
+			return err
+		}
+	}
+	return err
+}
+
+// accepted returns the secrets that are currently
+// valid for this entry.
+func (s *webhookSecret) accepted(now time.Time) (secrets []string) {
+	secrets = append(secrets, s.Secret)
+	if s.Previous != "" {
+		if s.previousUntil.IsZero() || now.Before(s.previousUntil) {
+			secrets = append(secrets, s.Previous)
+		}
+	}
+	return secrets
+}
+
+// secretFor returns the most specific webhook secret
+// configured for the given repo or nil if no secret
+// applies to it.
+func (c *config) secretFor(repo string) (secret *webhookSecret) {
+	for i := range c.webhookSecrets {
+		s := &c.webhookSecrets[i]
+		if !prefixCovers(s.Prefix, repo) {
+			continue
+		}
+		if secret == nil || len(s.Prefix) > len(secret.Prefix) {
+			secret = s
+		}
+	}
+	return secret
+}
+
+// prefixCovers reports whether prefix is repo or one of the
+// directories above it so that a prefix of host/Org doesn't
+// cover host/OrgOther. An empty prefix covers every repo.
+func prefixCovers(prefix, repo string) bool {
+	if prefix == "" || repo == prefix {
+		return true
+	}
+	return strings.HasPrefix(repo, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// checkSignature verifies the signature header against the
+// HMAC-SHA256 of body using the secrets configured for repo.
+// If no secrets are configured verification is skipped.
+func (c *config) checkSignature(repo string, body []byte, header string) error {
+	return c.checkSecret(repo, header, func(secret string) bool {
+		return validSignature(body, header, secret)
+	})
+}
+
+// checkHexSignature verifies a signature header that holds
+// only the hex encoded HMAC-SHA256 of body (e.g., Gitea's
+// X-Gitea-Signature) using the secrets configured for repo.
+func (c *config) checkHexSignature(repo string, body []byte, header string) error {
+	return c.checkSecret(repo, header, func(secret string) bool {
+		return validHMAC(body, header, secret)
+	})
+}
+
+// checkToken verifies a token header that carries the
+// secret itself (e.g., X-Gitlab-Token) against the secrets
+// configured for repo. If no secrets are configured
+// verification is skipped.
+func (c *config) checkToken(repo, header string) error {
+	return c.checkSecret(repo, header, func(secret string) bool {
+		return subtle.ConstantTimeCompare([]byte(header), []byte(secret)) == 1
+	})
+}
+
+// checkSecret looks up the secrets that apply to repo and
+// returns nil if valid accepts any of them. Once any secret
+// is configured a hook for a repo that no secret covers is
+// rejected. repo comes from the unverified payload but a
+// sender can only pick a secret it has to know to sign with.
+func (c *config) checkSecret(repo, header string, valid func(secret string) bool) error {
+	if len(c.webhookSecrets) == 0 {
+		return nil
+	}
+	secret := c.secretFor(repo)
+	if secret == nil {
+		return errSignatureNoSecret
+	}
+	if header == "" {
+		return errSignatureMissing
+	}
+	for _, s := range secret.accepted(time.Now()) {
+		if valid(s) {
+			return nil
+		}
+	}
+	return errSignatureMismatch
+}
+
+// validSignature reports whether header holds the
+// "sha256=<hex>" HMAC of body keyed with secret.
+func validSignature(body []byte, header, secret string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	return validHMAC(body, strings.TrimPrefix(header, prefix), secret)
+}
+
+// validHMAC reports whether sig is the hex encoded
+// HMAC-SHA256 of body keyed with secret.
+func validHMAC(body []byte, sig, secret string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
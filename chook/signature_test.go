@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSecretsConfig(t *testing.T, secrets ...webhookSecret) *config {
+	t.Helper()
+	c := &config{webhookSecrets: secrets}
+	for i := range c.webhookSecrets {
+		if err := c.webhookSecrets[i].setDefaults(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	sig := sign(body, "secret")
+	cases := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"valid", "sha256=" + sig, true},
+		{"missing prefix", sig, false},
+		{"sha1 prefix", "sha1=" + sig, false},
+		{"wrong secret", "sha256=" + sign(body, "other"), false},
+		{"not hex", "sha256=zz", false},
+		{"empty", "", false},
+	}
+	for _, tc := range cases {
+		if got := validSignature(body, tc.header, "secret"); got != tc.want {
+			t.Errorf("%s: validSignature = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+	if !validHMAC(body, sig, "secret") {
+		t.Error("validHMAC rejected a valid signature")
+	}
+	if validHMAC([]byte("tampered"), sig, "secret") {
+		t.Error("validHMAC accepted a signature of a different body")
+	}
+}
+
+func TestSecretFor(t *testing.T) {
+	c := newSecretsConfig(t,
+		webhookSecret{Secret: "default"},
+		webhookSecret{Prefix: "github.company.com/Org", Secret: "org"},
+		webhookSecret{Prefix: "github.company.com/Org/special", Secret: "special"},
+	)
+	cases := map[string]string{
+		"github.company.com/Org/repo":         "org",
+		"github.company.com/Org/special/repo": "special",
+		"github.company.com/Org/special-repo": "org",
+		"github.company.com/OrgOther/repo":    "default",
+		"github.company.com/Other/repo":       "default",
+		"":                                    "default",
+	}
+	for repo, want := range cases {
+		s := c.secretFor(repo)
+		if s == nil || s.Secret != want {
+			t.Errorf("secretFor(%q) = %v, want secret %q", repo, s, want)
+		}
+	}
+	c = newSecretsConfig(t, webhookSecret{Prefix: "github.company.com/OrgA", Secret: "a"})
+	for _, repo := range []string{"evil.example.com/x/y", "github.company.com/OrgAB/y"} {
+		if s := c.secretFor(repo); s != nil {
+			t.Errorf("secretFor(%q) matched prefix '%s' for an uncovered repo", repo, s.Prefix)
+		}
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	body := []byte(`{}`)
+	c := newSecretsConfig(t, webhookSecret{Prefix: "github.company.com/OrgA", Secret: "a"})
+	cases := []struct {
+		name   string
+		repo   string
+		header string
+		want   error
+	}{
+		{"signed", "github.company.com/OrgA/r", "sha256=" + sign(body, "a"), nil},
+		{"unsigned", "github.company.com/OrgA/r", "", errSignatureMissing},
+		{"bad signature", "github.company.com/OrgA/r", "sha256=" + sign(body, "b"), errSignatureMismatch},
+		{"uncovered repo", "evil.example.com/x/y", "", errSignatureNoSecret},
+		{"uncovered signed repo", "evil.example.com/x/y", "sha256=" + sign(body, "a"), errSignatureNoSecret},
+		{"no repo", "", "", errSignatureNoSecret},
+	}
+	for _, tc := range cases {
+		if got := c.checkSignature(tc.repo, body, tc.header); got != tc.want {
+			t.Errorf("%s: checkSignature = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	// without any secrets nothing is verified
+	c = newSecretsConfig(t)
+	if err := c.checkSignature("evil.example.com/x/y", body, ""); err != nil {
+		t.Errorf("checkSignature without secrets = %v, want nil", err)
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	c := newSecretsConfig(t, webhookSecret{Secret: "token"})
+	if err := c.checkToken("gitlab.company.com/g/r", "token"); err != nil {
+		t.Errorf("checkToken with the secret = %v, want nil", err)
+	}
+	if err := c.checkToken("gitlab.company.com/g/r", "tokenx"); err != errSignatureMismatch {
+		t.Errorf("checkToken with a wrong token = %v, want %v", err, errSignatureMismatch)
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	body := []byte(`{}`)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	cases := []struct {
+		name   string
+		secret webhookSecret
+		signer string
+		want   error
+	}{
+		{"new secret", webhookSecret{Secret: "new", Previous: "old"}, "new", nil},
+		{"previous without deadline", webhookSecret{Secret: "new", Previous: "old"}, "old", nil},
+		{"previous before deadline", webhookSecret{Secret: "new", Previous: "old", PreviousUntil: future}, "old", nil},
+		{"previous after deadline", webhookSecret{Secret: "new", Previous: "old", PreviousUntil: past}, "old", errSignatureMismatch},
+		{"new after deadline", webhookSecret{Secret: "new", Previous: "old", PreviousUntil: past}, "new", nil},
+	}
+	for _, tc := range cases {
+		c := newSecretsConfig(t, tc.secret)
+		got := c.checkHexSignature("github.company.com/Org/r", body, sign(body, tc.signer))
+		if got != tc.want {
+			t.Errorf("%s: checkHexSignature = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	bad := webhookSecret{Secret: "new", PreviousUntil: "tomorrow"}
+	if err := bad.setDefaults(); err == nil {
+		t.Error("setDefaults accepted an invalid previous_until")
+	}
+	empty := webhookSecret{Prefix: "github.company.com/Org"}
+	if err := empty.setDefaults(); err == nil {
+		t.Error("setDefaults accepted an empty secret")
+	}
+}
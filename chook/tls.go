@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate from disk and loads it
+// again whenever the certificate or key file changes so that
+// renewed certificates are picked up without a restart
+type certReloader struct {
+	sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := cr.reload()
+	return cr, err
+}
+
+// latestModTime returns when the certificate or
+// key file last changed
+func (cr *certReloader) latestModTime() (t time.Time, err error) {
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t, err
+}
+
+// reload loads the certificate if it changed since it
+// was last loaded. Must be called with cr locked or
+// before cr is shared.
+func (cr *certReloader) reload() (err error) {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil && modTime.Equal(cr.modTime) {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil {
+		log.Infof("reloaded TLS certificate from '%s'", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return err
+}
+
+// getCertificate is used as tls.Config.GetCertificate. If
+// reloading fails, e.g., because only one of the files has
+// been replaced so far, the last good certificate is served.
+func (cr *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.Lock()
+	defer cr.Unlock()
+	err := cr.reload()
+	if err != nil {
+		log.Warnf("Unable to reload TLS certificate, serving the previous one: %s", err.Error())
+	}
+	return cr.cert, nil
+}
+
+// newTLSConfig returns the TLS config for the tls_*
+// directives in c or nil if TLS is not enabled
+func newTLSConfig(c *config) (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.TLSClientCAFile != "" {
+			return nil, errors.New("tls_client_ca_file requires tls_cert_file and tls_key_file")
+		}
+		return nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	cr, err := newCertReloader(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %s", err.Error())
+	}
+	tc := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+	if c.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in tls_client_ca_file '%s'", c.TLSClientCAFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
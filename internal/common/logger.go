@@ -0,0 +1,181 @@
+// Package common holds the logging, metrics and repo rules
+// that chook and ahoy share
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log levels in increasing order of severity
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// supported values for the log_format config directive
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logOutput is where every logger writes and is
+// configured by SetupLogging
+var logOutput = struct {
+	sync.Mutex
+	w       io.Writer
+	level   int
+	json    bool
+	secrets []string
+}{
+	w:     os.Stdout,
+	level: levelInfo,
+}
+
+// SetupLogging sets the minimum level and the format of
+// every log line
+func SetupLogging(level, format string) (err error) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	found := false
+	for i, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			logOutput.level = i
+			found = true
+		}
+	}
+	if !found {
+		err = fmt.Errorf("unknown log_level '%s', must be one of %s", level, strings.Join(levelNames, ", "))
+		return err
+	}
+	switch format {
+	case LogFormatText:
+		logOutput.json = false
+	case LogFormatJSON:
+		logOutput.json = true
+	default:
+		err = fmt.Errorf("unknown log_format '%s', must be '%s' or '%s'", format, LogFormatText, LogFormatJSON)
+	}
+	return err
+}
+
+// RedactSecret makes sure secret never shows up in the logs
+// even if it ends up in a message by accident
+func RedactSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.secrets = append(logOutput.secrets, secret)
+}
+
+// Logger writes leveled log lines with a set of fields
+// attached, e.g., the ID of the request being handled
+type Logger struct {
+	fields map[string]interface{}
+}
+
+// Log is the base logger that every other logger is
+// derived from
+var Log = &Logger{}
+
+// With returns a copy of l that adds key to every line
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debugf(format string, a ...interface{}) {
+	l.write(levelDebug, format, a...)
+}
+
+func (l *Logger) Infof(format string, a ...interface{}) {
+	l.write(levelInfo, format, a...)
+}
+
+func (l *Logger) Warnf(format string, a ...interface{}) {
+	l.write(levelWarn, format, a...)
+}
+
+func (l *Logger) Errorf(format string, a ...interface{}) {
+	l.write(levelError, format, a...)
+}
+
+func (l *Logger) write(level int, format string, a ...interface{}) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	if level < logOutput.level {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	msg := redact(fmt.Sprintf(format, a...))
+	var line string
+	if logOutput.json {
+		entry := make(map[string]interface{}, len(l.fields)+3)
+		for k, v := range l.fields {
+			entry[k] = redactValue(v)
+		}
+		entry["time"] = now
+		entry["level"] = levelNames[level]
+		entry["msg"] = msg
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{
+				"time": now, "level": levelNames[level], "msg": msg,
+			})
+		}
+		line = string(b)
+	} else {
+		keys := make([]string, 0, len(l.fields))
+		for k := range l.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %-5s %s", now, strings.ToUpper(levelNames[level]), msg)
+		for _, k := range keys {
+			v := redact(fmt.Sprint(l.fields[k]))
+			if strings.ContainsAny(v, " \"=") {
+				v = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(&b, " %s=%s", k, v)
+		}
+		line = b.String()
+	}
+	fmt.Fprintln(logOutput.w, line)
+}
+
+// redact replaces every secret in s. It has to run before
+// s is quoted or JSON encoded since both escape characters
+// a secret may contain.
+func redact(s string) string {
+	for _, secret := range logOutput.secrets {
+		s = strings.Replace(s, secret, "[redacted]", -1)
+	}
+	return s
+}
+
+// redactValue returns v with its secrets replaced. Values
+// that contain a secret are logged as a string.
+func redactValue(v interface{}) interface{} {
+	s := fmt.Sprint(v)
+	if r := redact(s); r != s {
+		return r
+	}
+	return v
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecret(t *testing.T) {
+	var out bytes.Buffer
+	logOutput.w = &out
+	secret := `p&ss<w>rd"\`
+	RedactSecret(secret)
+	for _, format := range []string{LogFormatText, LogFormatJSON} {
+		if err := SetupLogging("info", format); err != nil {
+			t.Fatal(err)
+		}
+		out.Reset()
+		Log.With("token", secret).With("count", 1).Infof("using '%s'", secret)
+		line := out.String()
+		// json escapes & and < so look for both spellings
+		if strings.Contains(line, "p&ss") || strings.Contains(line, `p\u0026ss`) {
+			t.Errorf("%s: secret in log line %s", format, line)
+		}
+		if strings.Count(line, "[redacted]") != 2 {
+			t.Errorf("%s: want the message and the field redacted in %s", format, line)
+		}
+	}
+}
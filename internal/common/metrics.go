@@ -0,0 +1,226 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MetricsPath is where metrics are served in the
+// Prometheus text exposition format
+const MetricsPath = "/metrics"
+
+// defaultBuckets are the upper bounds in seconds of the
+// buckets used by latency histograms
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is anything that can write itself out in the
+// Prometheus text exposition format
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// metrics holds every metric served on MetricsPath
+var metrics []metric
+
+// labelEscaper escapes label values as the
+// exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders names and the values in key as
+// {name="value",...} with any extra pairs appended
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(v)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue renders v the way Prometheus expects
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// sortedKeys returns the keys of m in order so
+// the output is stable between scrapes
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// NewCounterVec creates a counter and adds it to metrics
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[labelKey(values)]++
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, k), formatValue(c.values[k]))
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// NewGaugeVec creates a gauge and adds it to metrics
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, g)
+	return g
+}
+
+// Set sets the gauge with the given label values to v
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.values[labelKey(values)] = v
+}
+
+// Remove drops the gauge with the given label values,
+// e.g., once the thing it describes is gone
+func (g *GaugeVec) Remove(values ...string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.values, labelKey(values))
+}
+
+func (g *GaugeVec) writeTo(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, k), formatValue(g.values[k]))
+	}
+}
+
+// histogramSeries holds the observations for one
+// set of label values
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+// NewHistogramVec creates a histogram with defaultBuckets
+// and adds it to metrics
+func NewHistogramVec(name, help string, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: defaultBuckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	metrics = append(metrics, h)
+	return h
+}
+
+// Observe records v for the given label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := labelKey(values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatValue(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), s.count)
+	}
+}
+
+// HandlerMetrics serves every metric in the
+// Prometheus text exposition format
+func HandlerMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a repo_allow or repo_deny pattern as a
+// regular expression instead of a glob
+const regexPrefix = "regex:"
+
+// repoPattern matches repo names (host/org/name) against
+// either a glob or a regular expression
+type repoPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// newRepoPattern compiles p. Patterns starting with "regex:"
+// are regular expressions matched against the whole repo
+// name, anything else is a glob where * does not match a "/",
+// e.g., github.company.com/Org/*
+func newRepoPattern(p string) (rp repoPattern, err error) {
+	rp.pattern = p
+	if strings.HasPrefix(p, regexPrefix) {
+		rp.re, err = regexp.Compile("^(?:" + strings.TrimPrefix(p, regexPrefix) + ")$")
+		return rp, err
+	}
+	_, err = path.Match(p, "")
+	return rp, err
+}
+
+func (rp repoPattern) match(repo string) bool {
+	if rp.re != nil {
+		return rp.re.MatchString(repo)
+	}
+	ok, _ := path.Match(rp.pattern, repo)
+	return ok
+}
+
+// RepoRules decides which repos may be registered. A repo is
+// rejected if it matches any deny pattern or if there are
+// allow patterns and it matches none of them.
+type RepoRules struct {
+	allow []repoPattern
+	deny  []repoPattern
+}
+
+// NewRepoRules compiles the allow and deny patterns
+func NewRepoRules(allow, deny []string) (rules RepoRules, err error) {
+	for _, p := range allow {
+		rp, err := newRepoPattern(p)
+		if err != nil {
+			return rules, fmt.Errorf("invalid repo_allow pattern '%s': %s", p, err.Error())
+		}
+		rules.allow = append(rules.allow, rp)
+	}
+	for _, p := range deny {
+		rp, err := newRepoPattern(p)
+		if err != nil {
+			return rules, fmt.Errorf("invalid repo_deny pattern '%s': %s", p, err.Error())
+		}
+		rules.deny = append(rules.deny, rp)
+	}
+	return rules, err
+}
+
+// Check returns an error explaining why repo is rejected
+// or nil if it is allowed
+func (rules RepoRules) Check(repo string) error {
+	for _, rp := range rules.deny {
+		if rp.match(repo) {
+			return fmt.Errorf("repo '%s' matches repo_deny pattern '%s'", repo, rp.pattern)
+		}
+	}
+	if len(rules.allow) == 0 {
+		return nil
+	}
+	for _, rp := range rules.allow {
+		if rp.match(repo) {
+			return nil
+		}
+	}
+	return fmt.Errorf("repo '%s' does not match any repo_allow pattern", repo)
+}
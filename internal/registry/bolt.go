@@ -0,0 +1,283 @@
+package registry
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltTimeout is how long to wait for the lock on the
+// database file which chook and ahoy share
+const boltTimeout = 10 * time.Second
+
+var (
+	boltReposBucket   = []byte("repos")
+	boltTriggerBucket = []byte("trigger")
+	boltTriggerKey    = []byte("count")
+	boltDeliveries    = []byte("deliveries")
+)
+
+// Bolt stores repos as JSON in a single local bbolt
+// database file. The file is opened for each operation so
+// that chook and ahoy can both use it from the same host,
+// which bbolt's file lock would block while either holds it
+// open.
+type Bolt struct {
+	path string
+}
+
+// NewBolt returns a registry kept in the bbolt file at path
+func NewBolt(path string) *Bolt {
+	return &Bolt{path: path}
+}
+
+// tx runs fn in a read-write transaction
+func (b *Bolt) tx(fn func(tx *bolt.Tx) error) (err error) {
+	db, err := bolt.Open(b.path, 0664, &bolt.Options{Timeout: boltTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// viewTx runs fn in a read-only transaction. The file is
+// opened read-only so reads only wait for writers and not
+// for each other.
+func (b *Bolt) viewTx(fn func(tx *bolt.Tx) error) (err error) {
+	if _, err = os.Stat(b.path); os.IsNotExist(err) {
+		// nothing has been written yet
+		return fn(nil)
+	}
+	db, err := bolt.Open(b.path, 0664, &bolt.Options{Timeout: boltTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// view runs fn in a read-only transaction. Buckets are nil
+// if nothing has been written to them yet.
+func (b *Bolt) view(fn func(repos, trigger *bolt.Bucket) error) (err error) {
+	return b.viewTx(func(tx *bolt.Tx) error {
+		if tx == nil {
+			return fn(nil, nil)
+		}
+		return fn(tx.Bucket(boltReposBucket), tx.Bucket(boltTriggerBucket))
+	})
+}
+
+// update runs fn in a read-write transaction with
+// both buckets created
+func (b *Bolt) update(fn func(repos, trigger *bolt.Bucket) error) (err error) {
+	return b.tx(func(tx *bolt.Tx) error {
+		repos, err := tx.CreateBucketIfNotExists(boltReposBucket)
+		if err != nil {
+			return err
+		}
+		trigger, err := tx.CreateBucketIfNotExists(boltTriggerBucket)
+		if err != nil {
+			return err
+		}
+		return fn(repos, trigger)
+	})
+}
+
+func (b *Bolt) PutRepo(rec Record) (err error) {
+	return b.update(func(repos, trigger *bolt.Bucket) error {
+		var stored Record
+		if v := repos.Get([]byte(rec.Repo)); v != nil {
+			err := json.Unmarshal(v, &stored)
+			if err != nil {
+				return err
+			}
+		}
+		stored.merge(rec)
+		v, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return repos.Put([]byte(rec.Repo), v)
+	})
+}
+
+func (b *Bolt) DeleteRepo(repo string) (err error) {
+	return b.update(func(repos, trigger *bolt.Bucket) error {
+		var children [][]byte
+		err := repos.ForEach(func(k, v []byte) error {
+			var rec Record
+			err := json.Unmarshal(v, &rec)
+			if err != nil {
+				return err
+			}
+			if rec.Parent == repo {
+				children = append(children, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// keys can't be deleted while iterating
+		// so do it once we're done
+		for _, k := range children {
+			err = repos.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return repos.Delete([]byte(repo))
+	})
+}
+
+func (b *Bolt) SetRepoAttribute(repo, attribute, value string) (err error) {
+	return b.update(func(repos, trigger *bolt.Bucket) error {
+		v := repos.Get([]byte(repo))
+		if v == nil {
+			return ErrRepoNotRegistered
+		}
+		// round trip through a map so any attribute
+		// can be set, not just the ones we know about
+		stored := make(map[string]interface{})
+		err := json.Unmarshal(v, &stored)
+		if err != nil {
+			return err
+		}
+		stored[attribute] = value
+		v, err = json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return repos.Put([]byte(repo), v)
+	})
+}
+
+func (b *Bolt) GetRepo(repo string) (rec Record, err error) {
+	err = b.view(func(repos, trigger *bolt.Bucket) error {
+		if repos == nil {
+			return ErrRepoNotRegistered
+		}
+		v := repos.Get([]byte(repo))
+		if v == nil {
+			return ErrRepoNotRegistered
+		}
+		return json.Unmarshal(v, &rec)
+	})
+	return rec, err
+}
+
+func (b *Bolt) ListRepos() (recs []Record, err error) {
+	err = b.view(func(repos, trigger *bolt.Bucket) error {
+		if repos == nil {
+			return nil
+		}
+		return repos.ForEach(func(k, v []byte) error {
+			var rec Record
+			err := json.Unmarshal(v, &rec)
+			if err != nil {
+				return err
+			}
+			recs = append(recs, rec)
+			return nil
+		})
+	})
+	return recs, err
+}
+
+func (b *Bolt) BumpTrigger() (count int, err error) {
+	err = b.update(func(repos, trigger *bolt.Bucket) error {
+		if v := trigger.Get(boltTriggerKey); v != nil {
+			count, err = strconv.Atoi(string(v))
+			if err != nil {
+				return err
+			}
+		}
+		count++
+		return trigger.Put(boltTriggerKey, []byte(strconv.Itoa(count)))
+	})
+	return count, err
+}
+
+func (b *Bolt) GetTrigger() (count int, err error) {
+	err = b.view(func(repos, trigger *bolt.Bucket) error {
+		if trigger == nil {
+			return nil
+		}
+		if v := trigger.Get(boltTriggerKey); v != nil {
+			count, err = strconv.Atoi(string(v))
+		}
+		return err
+	})
+	return count, err
+}
+
+func (b *Bolt) DeliverySeen(id string) (seen bool, err error) {
+	err = b.viewTx(func(tx *bolt.Tx) error {
+		if tx == nil || tx.Bucket(boltDeliveries) == nil {
+			return nil
+		}
+		v := tx.Bucket(boltDeliveries).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		expires, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return err
+		}
+		seen = time.Now().Unix() < expires
+		return nil
+	})
+	return seen, err
+}
+
+// claimDelivery checks for and records the delivery in the
+// same transaction so only one caller can claim it
+func (b *Bolt) ClaimDelivery(id string, expires time.Time) (claimed bool, err error) {
+	err = b.tx(func(tx *bolt.Tx) error {
+		deliveries, err := tx.CreateBucketIfNotExists(boltDeliveries)
+		if err != nil {
+			return err
+		}
+		// there is no TTL in bbolt so drop the expired
+		// deliveries whenever a new one is added
+		now := time.Now().Unix()
+		var expired [][]byte
+		err = deliveries.ForEach(func(k, v []byte) error {
+			e, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil || e <= now {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = deliveries.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		if deliveries.Get([]byte(id)) != nil {
+			// expired deliveries were dropped above
+			return nil
+		}
+		claimed = true
+		return deliveries.Put([]byte(id), []byte(strconv.FormatInt(expires.Unix(), 10)))
+	})
+	return claimed, err
+}
+
+func (b *Bolt) ReleaseDelivery(id string) (err error) {
+	return b.tx(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket(boltDeliveries)
+		if deliveries == nil {
+			return nil
+		}
+		return deliveries.Delete([]byte(id))
+	})
+}
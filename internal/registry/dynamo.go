@@ -0,0 +1,289 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Dynamo stores repos as items in a DynamoDB table
+// keyed by "repo". The trigger count is kept on an item in
+// the same table whose key is the configured trigger key.
+type Dynamo struct {
+	table      string
+	triggerKey string
+	svc        dynamodbiface.DynamoDBAPI
+}
+
+// NewDynamo returns a registry backed by table in region
+// whose trigger count is kept on the item keyed triggerKey
+func NewDynamo(region, table, triggerKey string) (*Dynamo, error) {
+	sess, err := session.NewSession(
+		&aws.Config{Region: aws.String(region)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	d := Dynamo{
+		table:      table,
+		triggerKey: triggerKey,
+		svc:        dynamodb.New(sess),
+	}
+	return &d, err
+}
+
+func (d *Dynamo) key(repo string) map[string]*dynamodb.AttributeValue {
+	kvalue := make(map[string]*dynamodb.AttributeValue)
+	kvalue["repo"] = &dynamodb.AttributeValue{
+		S: aws.String(repo)}
+	return kvalue
+}
+
+func (d *Dynamo) PutRepo(rec Record) (err error) {
+	// use an update instead of a put so attributes that are
+	// not part of rec (e.g., lastTag) survive new pushes
+	item := rec.dynamoFormat()
+	delete(item, "repo")
+	var attrs []string
+	for attr := range item {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	names := make(map[string]*string)
+	values := make(map[string]*dynamodb.AttributeValue)
+	expr := "SET"
+	for i, attr := range attrs {
+		name := fmt.Sprintf("#a%d", i)
+		value := fmt.Sprintf(":v%d", i)
+		names[name] = aws.String(attr)
+		values[value] = item[attr]
+		if i > 0 {
+			expr += ","
+		}
+		expr += fmt.Sprintf(" %s = %s", name, value)
+	}
+	input := dynamodb.UpdateItemInput{
+		TableName:                 &d.table,
+		Key:                       d.key(rec.Repo),
+		UpdateExpression:          aws.String(expr),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+	_, err = d.svc.UpdateItem(&input)
+	return err
+}
+
+func (d *Dynamo) DeleteRepo(repo string) (err error) {
+	children, err := d.childRepos(repo)
+	if err != nil {
+		return err
+	}
+	// delete the children first so none are left
+	// behind if we fail part way through
+	for _, child := range append(children, repo) {
+		input := dynamodb.DeleteItemInput{
+			TableName: &d.table,
+			Key:       d.key(child),
+		}
+		_, err = d.svc.DeleteItem(&input)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// childRepos returns the names of the modules
+// registered with repo as their parent
+func (d *Dynamo) childRepos(repo string) (children []string, err error) {
+	params := dynamodb.ScanInput{
+		TableName:            &d.table,
+		FilterExpression:     aws.String("parent = :p"),
+		ProjectionExpression: aws.String("repo"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":p": {S: aws.String(repo)},
+		},
+	}
+	err = d.svc.ScanPages(&params,
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				if v, ok := item["repo"]; ok && v.S != nil {
+					children = append(children, *v.S)
+				}
+			}
+			return true
+		})
+	return children, err
+}
+
+func (d *Dynamo) SetRepoAttribute(repo, attribute, value string) (err error) {
+	input := dynamodb.UpdateItemInput{
+		TableName:           &d.table,
+		Key:                 d.key(repo),
+		ConditionExpression: aws.String("attribute_exists(repo)"),
+		UpdateExpression:    aws.String("SET #a = :v"),
+		ExpressionAttributeNames: map[string]*string{
+			"#a": aws.String(attribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": {S: aws.String(value)},
+		},
+	}
+	_, err = d.svc.UpdateItem(&input)
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			err = ErrRepoNotRegistered
+		}
+	}
+	return err
+}
+
+func (d *Dynamo) GetRepo(repo string) (rec Record, err error) {
+	if repo == d.triggerKey || isDeliveryKey(repo) {
+		return rec, ErrRepoNotRegistered
+	}
+	input := dynamodb.GetItemInput{
+		TableName: &d.table,
+		Key:       d.key(repo),
+	}
+	rvalue, err := d.svc.GetItem(&input)
+	if err != nil {
+		return rec, err
+	}
+	if len(rvalue.Item) == 0 {
+		return rec, ErrRepoNotRegistered
+	}
+	err = dynamodbattribute.UnmarshalMap(rvalue.Item, &rec)
+	return rec, err
+}
+
+func (d *Dynamo) ListRepos() (repos []Record, err error) {
+	params := dynamodb.ScanInput{
+		TableName: &d.table,
+	}
+	var uerr error
+	err = d.svc.ScanPages(&params,
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var rec Record
+				uerr = dynamodbattribute.UnmarshalMap(item, &rec)
+				if uerr != nil {
+					return false
+				}
+				if rec.Repo != "" && rec.Repo != d.triggerKey && !isDeliveryKey(rec.Repo) {
+					repos = append(repos, rec)
+				}
+			}
+			return true
+		})
+	if err == nil {
+		err = uerr
+	}
+	return repos, err
+}
+
+func (d *Dynamo) BumpTrigger() (count int, err error) {
+	input := dynamodb.UpdateItemInput{
+		TableName:        &d.table,
+		Key:              d.key(d.triggerKey),
+		UpdateExpression: aws.String("ADD #c :one"),
+		ExpressionAttributeNames: map[string]*string{
+			"#c": aws.String("count"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	}
+	rvalue, err := d.svc.UpdateItem(&input)
+	if err != nil {
+		return count, err
+	}
+	val, ok := rvalue.Attributes["count"]
+	if !ok {
+		err = errors.New("trigger update did not return a count")
+		return count, err
+	}
+	err = dynamodbattribute.Unmarshal(val, &count)
+	return count, err
+}
+
+func (d *Dynamo) GetTrigger() (count int, err error) {
+	input := dynamodb.GetItemInput{
+		TableName: &d.table,
+		Key:       d.key(d.triggerKey),
+	}
+	rvalue, err := d.svc.GetItem(&input)
+	if err != nil {
+		return count, err
+	}
+	if val, ok := rvalue.Item["count"]; ok {
+		err = dynamodbattribute.Unmarshal(val, &count)
+	}
+	return count, err
+}
+
+func (d *Dynamo) DeliverySeen(id string) (seen bool, err error) {
+	input := dynamodb.GetItemInput{
+		TableName: &d.table,
+		Key:       d.key(deliveryKeyPrefix + id),
+	}
+	rvalue, err := d.svc.GetItem(&input)
+	if err != nil {
+		return seen, err
+	}
+	// DynamoDB can take a while to delete items whose
+	// TTL has passed so check the expiry ourselves
+	var expires int64
+	if val, ok := rvalue.Item["expires"]; ok {
+		err = dynamodbattribute.Unmarshal(val, &expires)
+	}
+	seen = time.Now().Unix() < expires
+	return seen, err
+}
+
+// claimDelivery stores the expiry in the "expires" attribute
+// as epoch seconds so it can be set as the table's TTL
+// attribute to have DynamoDB clean up old deliveries. The put
+// is conditional so only one caller can claim a delivery,
+// unless its expiry has passed and DynamoDB hasn't deleted
+// it yet.
+func (d *Dynamo) ClaimDelivery(id string, expires time.Time) (claimed bool, err error) {
+	input := dynamodb.PutItemInput{
+		TableName: &d.table,
+		Item: map[string]*dynamodb.AttributeValue{
+			"repo":    {S: aws.String(deliveryKeyPrefix + id)},
+			"expires": {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#r) OR #e <= :now"),
+		ExpressionAttributeNames: map[string]*string{"#r": aws.String("repo"), "#e": aws.String("expires")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	}
+	_, err = d.svc.PutItem(&input)
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
+
+func (d *Dynamo) ReleaseDelivery(id string) (err error) {
+	input := dynamodb.DeleteItemInput{
+		TableName: &d.table,
+		Key:       d.key(deliveryKeyPrefix + id),
+	}
+	_, err = d.svc.DeleteItem(&input)
+	return err
+}
@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamo is an in memory table that implements the calls
+// the trigger uses. Like DynamoDB each call is atomic but
+// nothing stops callers from racing between calls.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{items: map[string]map[string]*dynamodb.AttributeValue{}}
+}
+
+func (f *fakeDynamo) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item := map[string]*dynamodb.AttributeValue{}
+	for k, v := range f.items[*in.Key["repo"].S] {
+		item[k] = v
+	}
+	return &dynamodb.GetItemOutput{Item: item}, nil
+}
+
+// PutItem only understands the condition that
+// claimDelivery sends
+func (f *fakeDynamo) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := *in.Item["repo"].S
+	if in.ConditionExpression != nil {
+		if *in.ConditionExpression != "attribute_not_exists(#r) OR #e <= :now" {
+			panic("unexpected condition expression " + *in.ConditionExpression)
+		}
+		if item, ok := f.items[key]; ok {
+			expires, _ := strconv.Atoi(*item["expires"].N)
+			now, _ := strconv.Atoi(*in.ExpressionAttributeValues[":now"].N)
+			if expires > now {
+				return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+			}
+		}
+	}
+	f.items[key] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, *in.Key["repo"].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// UpdateItem only understands the "ADD #c :one" expression
+// that bumpTrigger sends
+func (f *fakeDynamo) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if *in.UpdateExpression != "ADD #c :one" {
+		panic("unexpected update expression " + *in.UpdateExpression)
+	}
+	key := *in.Key["repo"].S
+	attr := *in.ExpressionAttributeNames["#c"]
+	add, _ := strconv.Atoi(*in.ExpressionAttributeValues[":one"].N)
+	item, ok := f.items[key]
+	if !ok {
+		item = map[string]*dynamodb.AttributeValue{"repo": {S: aws.String(key)}}
+		f.items[key] = item
+	}
+	count := 0
+	if v, ok := item[attr]; ok {
+		count, _ = strconv.Atoi(*v.N)
+	}
+	count += add
+	item[attr] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(count))}
+	return &dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{attr: item[attr]},
+	}, nil
+}
+
+func TestBumpTriggerConcurrent(t *testing.T) {
+	const bumps = 50
+	fake := newFakeDynamo()
+	d := &Dynamo{table: "goarder", triggerKey: "00000trigger", svc: fake}
+	counts := make(chan int, bumps)
+	var wg sync.WaitGroup
+	for i := 0; i < bumps; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count, err := d.BumpTrigger()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			counts <- count
+		}()
+	}
+	wg.Wait()
+	close(counts)
+	// every bump has to see its own count, a lost
+	// update shows up as a count seen twice
+	seen := map[int]bool{}
+	for count := range counts {
+		if seen[count] {
+			t.Errorf("count %d returned by more than one bump", count)
+		}
+		seen[count] = true
+	}
+	count, err := d.GetTrigger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != bumps {
+		t.Errorf("trigger = %d after %d concurrent bumps", count, bumps)
+	}
+}
+
+func TestBumpTriggerCreatesItem(t *testing.T) {
+	fake := newFakeDynamo()
+	d := &Dynamo{table: "goarder", triggerKey: "00000trigger", svc: fake}
+	count, err := d.BumpTrigger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("first bump of a missing trigger = %d, want 1", count)
+	}
+}
@@ -0,0 +1,226 @@
+// Package registry stores the repos registered with chook and
+// the trigger count that tells ahoy when to rescan them, either
+// in a DynamoDB table or in a local bbolt file
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// supported values for the backend config directive
+const (
+	BackendDynamoDB = "dynamodb"
+	BackendLocal    = "local"
+)
+
+// ErrRepoNotRegistered is returned for operations on
+// repos that aren't in the registry
+var ErrRepoNotRegistered = errors.New("repo is not registered")
+
+// deliveryKeyPrefix starts the key of the items that record
+// processed hook deliveries in the DynamoDB table. Repo
+// names never contain a ":" so they can't clash.
+const deliveryKeyPrefix = "delivery:"
+
+// isDeliveryKey reports whether key is that of a delivery
+// rather than a repo
+func isDeliveryKey(key string) bool {
+	return strings.HasPrefix(key, deliveryKeyPrefix)
+}
+
+// commitIdPattern matches full SHA-1 and SHA-256 commit IDs
+var commitIdPattern = regexp.MustCompile(`^([0-9a-fA-F]{40}|[0-9a-fA-F]{64})$`)
+
+// scpURLPattern matches scp style ssh clone URLs,
+// e.g., git@github.company.com:Org/repo.git
+var scpURLPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[A-Za-z0-9._~/+-]+$`)
+
+// CheckCommitId returns an error unless id is a full hex
+// commit ID. Commit IDs come from hook payloads and are
+// passed to git so anything else, e.g., an option, is refused.
+func CheckCommitId(id string) error {
+	if !commitIdPattern.MatchString(id) {
+		return fmt.Errorf("commit ID '%s' is not a 40 or 64 character hex SHA", id)
+	}
+	return nil
+}
+
+// CheckCloneURL returns an error unless u is an https, ssh
+// or scp style ssh URL. Clone URLs come from hook payloads
+// and are passed to git so anything that could be taken for
+// an option or another transport is refused.
+func CheckCloneURL(u string) error {
+	if strings.HasPrefix(u, "-") {
+		return fmt.Errorf("clone URL '%s' begins with a dash", u)
+	}
+	if !strings.Contains(u, "://") {
+		if !scpURLPattern.MatchString(u) {
+			return fmt.Errorf("clone URL '%s' is not an https or ssh URL", u)
+		}
+		return nil
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("could not parse clone URL '%s'", u)
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "ssh" {
+		return fmt.Errorf("clone URL '%s' is not an https or ssh URL", u)
+	}
+	if parsed.Host == "" || strings.HasPrefix(parsed.Host, "-") {
+		return fmt.Errorf("clone URL '%s' has no valid host", u)
+	}
+	return nil
+}
+
+// Repos reads and writes the registered repos and reads the
+// trigger count, which is all ahoy needs
+type Repos interface {
+	// PutRepo creates the repo or overwrites the fields of an
+	// existing repo that are set on rec
+	PutRepo(rec Record) error
+	// DeleteRepo removes the repo along with any modules
+	// registered as its children
+	DeleteRepo(repo string) error
+	// SetRepoAttribute sets a single attribute on a repo
+	// and returns ErrRepoNotRegistered if it doesn't exist
+	SetRepoAttribute(repo, attribute, value string) error
+	// GetRepo returns a single repo or
+	// ErrRepoNotRegistered if it doesn't exist
+	GetRepo(repo string) (Record, error)
+	// ListRepos returns every registered repo
+	ListRepos() ([]Record, error)
+	// GetTrigger returns the current trigger count
+	GetTrigger() (int, error)
+}
+
+// Registry adds bumping the trigger and recording hook
+// deliveries which only chook does
+type Registry interface {
+	Repos
+	// BumpTrigger atomically increments the trigger count,
+	// creating it if needed, and returns the new count
+	BumpTrigger() (int, error)
+	// DeliverySeen reports whether the hook delivery with
+	// the given ID was claimed and hasn't expired yet
+	DeliverySeen(id string) (bool, error)
+	// ClaimDelivery atomically records the hook delivery with
+	// the given ID until expires. It returns false if the
+	// delivery was already claimed and hasn't expired.
+	ClaimDelivery(id string, expires time.Time) (bool, error)
+	// ReleaseDelivery forgets the hook delivery with the
+	// given ID so that it can be claimed again
+	ReleaseDelivery(id string) error
+}
+
+// Record is the normalized form of a repo that every
+// webhook provider produces and that is stored in the registry
+type Record struct {
+	Repo              string `json:"repo" dynamodbav:"repo"`
+	LastCommitId      string `json:"lastCommitId" dynamodbav:"lastCommitId"`
+	LastCommitMessage string `json:"lastCommitMessage" dynamodbav:"lastCommitMessage"`
+	LastCommitUser    string `json:"lastCommitUser" dynamodbav:"lastCommitUser"`
+	LastTag           string `json:"lastTag,omitempty" dynamodbav:"lastTag,omitempty"`
+	LastRelease       string `json:"lastRelease,omitempty" dynamodbav:"lastRelease,omitempty"`
+	// CloneURL is where the repo can be cloned from
+	CloneURL string `json:"cloneURL,omitempty" dynamodbav:"cloneURL,omitempty"`
+	// ModulePath is the module path declared in the root go.mod
+	// and is set by ahoy when it syncs the repo
+	ModulePath string `json:"modulePath,omitempty" dynamodbav:"modulePath,omitempty"`
+	// Warning describes problems ahoy found with the repo,
+	// e.g., a module path that doesn't match the repo name
+	Warning string `json:"warning,omitempty" dynamodbav:"warning,omitempty"`
+	// Parent is set on the modules ahoy finds nested in a
+	// repo and is the name of the repo they belong to
+	Parent string `json:"parent,omitempty" dynamodbav:"parent,omitempty"`
+	// LastDelivery is the ID of the last hook delivery
+	// that touched the repo
+	LastDelivery string `json:"lastDelivery,omitempty" dynamodbav:"lastDelivery,omitempty"`
+}
+
+// ImportPath is the path the repo is fetched and
+// served under
+func (g *Record) ImportPath() string {
+	if g.ModulePath != "" {
+		return g.ModulePath
+	}
+	return g.Repo
+}
+
+// merge overwrites the commit fields of g with those of rec
+// and any other fields that are set on rec
+func (g *Record) merge(rec Record) {
+	g.Repo = rec.Repo
+	g.LastCommitId = rec.LastCommitId
+	g.LastCommitMessage = rec.LastCommitMessage
+	g.LastCommitUser = rec.LastCommitUser
+	if rec.LastTag != "" {
+		g.LastTag = rec.LastTag
+	}
+	if rec.LastRelease != "" {
+		g.LastRelease = rec.LastRelease
+	}
+	if rec.CloneURL != "" {
+		g.CloneURL = rec.CloneURL
+	}
+	if rec.ModulePath != "" {
+		g.ModulePath = rec.ModulePath
+	}
+	if rec.Warning != "" {
+		g.Warning = rec.Warning
+	}
+	if rec.Parent != "" {
+		g.Parent = rec.Parent
+	}
+	if rec.LastDelivery != "" {
+		g.LastDelivery = rec.LastDelivery
+	}
+}
+
+func (g *Record) dynamoFormat() map[string]*dynamodb.AttributeValue {
+	rvalue := make(map[string]*dynamodb.AttributeValue)
+	rvalue["repo"] = &dynamodb.AttributeValue{
+		S: aws.String(g.Repo)}
+	rvalue["lastCommitId"] = &dynamodb.AttributeValue{
+		S: aws.String(g.LastCommitId)}
+	rvalue["lastCommitMessage"] = &dynamodb.AttributeValue{
+		S: aws.String(g.LastCommitMessage)}
+	rvalue["lastCommitUser"] = &dynamodb.AttributeValue{
+		S: aws.String(g.LastCommitUser)}
+	if g.LastTag != "" {
+		rvalue["lastTag"] = &dynamodb.AttributeValue{
+			S: aws.String(g.LastTag)}
+	}
+	if g.LastRelease != "" {
+		rvalue["lastRelease"] = &dynamodb.AttributeValue{
+			S: aws.String(g.LastRelease)}
+	}
+	if g.CloneURL != "" {
+		rvalue["cloneURL"] = &dynamodb.AttributeValue{
+			S: aws.String(g.CloneURL)}
+	}
+	if g.ModulePath != "" {
+		rvalue["modulePath"] = &dynamodb.AttributeValue{
+			S: aws.String(g.ModulePath)}
+	}
+	if g.Warning != "" {
+		rvalue["warning"] = &dynamodb.AttributeValue{
+			S: aws.String(g.Warning)}
+	}
+	if g.Parent != "" {
+		rvalue["parent"] = &dynamodb.AttributeValue{
+			S: aws.String(g.Parent)}
+	}
+	if g.LastDelivery != "" {
+		rvalue["lastDelivery"] = &dynamodb.AttributeValue{
+			S: aws.String(g.LastDelivery)}
+	}
+	return rvalue
+}
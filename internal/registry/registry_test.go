@@ -0,0 +1,103 @@
+package registry
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClaimDelivery claims the same delivery from many
+// goroutines at once and checks that exactly one wins
+func testClaimDelivery(t *testing.T, r Registry) {
+	const claims = 20
+	expires := time.Now().Add(time.Hour)
+	won := make(chan bool, claims)
+	var wg sync.WaitGroup
+	for i := 0; i < claims; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed, err := r.ClaimDelivery("abc", expires)
+			if err != nil {
+				t.Error(err)
+			}
+			won <- claimed
+		}()
+	}
+	wg.Wait()
+	close(won)
+	winners := 0
+	for claimed := range won {
+		if claimed {
+			winners++
+		}
+	}
+	if winners != 1 {
+		t.Errorf("%d concurrent claims of a delivery succeeded, want 1", winners)
+	}
+	if seen, err := r.DeliverySeen("abc"); err != nil || !seen {
+		t.Errorf("deliverySeen of a claimed delivery = %t, %v", seen, err)
+	}
+	// a released delivery can be claimed again
+	if err := r.ReleaseDelivery("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := r.ClaimDelivery("abc", expires); err != nil || !claimed {
+		t.Errorf("claim of a released delivery = %t, %v", claimed, err)
+	}
+	// so can one whose claim expired
+	if _, err := r.ClaimDelivery("old", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := r.ClaimDelivery("old", expires); err != nil || !claimed {
+		t.Errorf("claim of an expired delivery = %t, %v", claimed, err)
+	}
+}
+
+func TestClaimDeliveryDynamo(t *testing.T) {
+	testClaimDelivery(t, &Dynamo{table: "goarder", triggerKey: "00000trigger", svc: newFakeDynamo()})
+}
+
+func TestClaimDeliveryBolt(t *testing.T) {
+	testClaimDelivery(t, NewBolt(filepath.Join(t.TempDir(), "registry.db")))
+}
+
+func TestCheckCommitId(t *testing.T) {
+	cases := map[string]bool{
+		"0123456789abcdef0123456789abcdef01234567":                         true,
+		"0123456789ABCDEF0123456789ABCDEF01234567":                         true,
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef": true,
+		"":        false,
+		"HEAD":    false,
+		"0123456": false,
+		"0123456789abcdef0123456789abcdef0123456g": false,
+		"--upload-pack=touch /tmp/pwned":           false,
+	}
+	for id, want := range cases {
+		if err := CheckCommitId(id); (err == nil) != want {
+			t.Errorf("CheckCommitId(%q) = %v, want valid %t", id, err, want)
+		}
+	}
+}
+
+func TestCheckCloneURL(t *testing.T) {
+	cases := map[string]bool{
+		"https://github.company.com/Org/repo.git":        true,
+		"ssh://git@github.company.com:7999/org/repo.git": true,
+		"git@github.company.com:Org/repo.git":            true,
+		"":                                               false,
+		"--upload-pack=touch /tmp/pwned":                 false,
+		"-oProxyCommand=x@host:repo":                     false,
+		"http://github.company.com/Org/repo.git":         false,
+		"file:///etc":                                    false,
+		"ext::sh -c touch% /tmp/pwned":                   false,
+		"https:///Org/repo.git":                          false,
+		"git@github.company.com:Org/repo with space":     false,
+	}
+	for u, want := range cases {
+		if err := CheckCloneURL(u); (err == nil) != want {
+			t.Errorf("CheckCloneURL(%q) = %v, want valid %t", u, err, want)
+		}
+	}
+}